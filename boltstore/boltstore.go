@@ -0,0 +1,318 @@
+package boltstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/internal/storeutil"
+	bolt "go.etcd.io/bbolt"
+)
+
+// New creates a session store backed by a bbolt database. Call Migrate to
+// create the buckets before using the store.
+func New(db *bolt.DB) *Store {
+	return &Store{
+		db:        db,
+		Bucket:    "sessions",
+		Now:       time.Now,
+		BatchSize: 1000,
+	}
+}
+
+// Store sessions in bbolt, a pure-Go embedded database. Sessions are kept in
+// one bucket, while a second bucket indexes them by expiry so cleanup doesn't
+// need to scan every session.
+//
+// Sessions are stored as:
+//
+//	expiry (unix nanoseconds, 8 bytes) | version (8 bytes) | data
+//
+// The expiry index maps expiry | id to an empty value.
+type Store struct {
+	db     *bolt.DB
+	Bucket string
+
+	// Used for testing
+	Now func() time.Time
+
+	// BatchSize is the maximum number of expired sessions removed per
+	// transaction during cleanup. Smaller batches hold the write lock for less
+	// time.
+	BatchSize int
+}
+
+var _ sesh.Store = (*Store)(nil)
+var _ sesh.Toucher = (*Store)(nil)
+var _ sesh.VersionedStore = (*Store)(nil)
+
+const headerSize = 16
+
+var errInvalidSession = errors.New("boltstore: invalid session")
+var errBatchSize = errors.New("boltstore: BatchSize must be greater than 0")
+
+type session struct {
+	expiry  time.Time
+	version int64
+	data    []byte
+}
+
+func encodeSession(s *session) []byte {
+	out := make([]byte, 0, headerSize+len(s.data))
+	out = binary.BigEndian.AppendUint64(out, uint64(s.expiry.UnixNano()))
+	out = binary.BigEndian.AppendUint64(out, uint64(s.version))
+	return append(out, s.data...)
+}
+
+// decodeSession copies the value, since bbolt values are only valid during the
+// transaction
+func decodeSession(value []byte) (*session, error) {
+	if len(value) < headerSize {
+		return nil, errInvalidSession
+	}
+	return &session{
+		expiry:  time.Unix(0, int64(binary.BigEndian.Uint64(value))),
+		version: int64(binary.BigEndian.Uint64(value[8:])),
+		data:    bytes.Clone(value[headerSize:]),
+	}, nil
+}
+
+// indexKey orders sessions by expiry
+func indexKey(id string, expiry time.Time) []byte {
+	key := make([]byte, 0, 8+len(id))
+	key = binary.BigEndian.AppendUint64(key, uint64(expiry.UnixNano()))
+	return append(key, id...)
+}
+
+func (s *Store) indexBucket() []byte {
+	return []byte(s.Bucket + "_expiry")
+}
+
+// Migrate creates the session and expiry index buckets
+func (s *Store) Migrate(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(s.Bucket)); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(s.indexBucket())
+		return err
+	})
+}
+
+// buckets returns the session and expiry index buckets
+func (s *Store) buckets(tx *bolt.Tx) (sessions, index *bolt.Bucket, err error) {
+	sessions, index = tx.Bucket([]byte(s.Bucket)), tx.Bucket(s.indexBucket())
+	if sessions == nil || index == nil {
+		return nil, nil, errors.New("boltstore: missing buckets, did you call Migrate?")
+	}
+	return sessions, index, nil
+}
+
+// find the session, including expired sessions
+func find(sessions *bolt.Bucket, id string) (*session, error) {
+	value := sessions.Get([]byte(id))
+	if value == nil {
+		return nil, nil
+	}
+	return decodeSession(value)
+}
+
+// put the session, replacing the existing session's index entry
+func put(sessions, index *bolt.Bucket, id string, prev, next *session) error {
+	if prev != nil {
+		if err := index.Delete(indexKey(id, prev.expiry)); err != nil {
+			return err
+		}
+	}
+	if err := index.Put(indexKey(id, next.expiry), nil); err != nil {
+		return err
+	}
+	return sessions.Put([]byte(id), encodeSession(next))
+}
+
+// Find returns the data for a session id from the store. If the session is not
+// found or expired, the data will be nil and the time will be zero, but there
+// will be no error.
+func (s *Store) Find(ctx context.Context, id string) (data []byte, expiry time.Time, err error) {
+	data, expiry, _, err = s.FindVersion(ctx, id)
+	return data, expiry, err
+}
+
+// FindVersion is like Find, but also returns the version of the session.
+func (s *Store) FindVersion(ctx context.Context, id string) (data []byte, expiry time.Time, version int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	var found *session
+	err = s.db.View(func(tx *bolt.Tx) error {
+		sessions, _, err := s.buckets(tx)
+		if err != nil {
+			return err
+		}
+		found, err = find(sessions, id)
+		return err
+	})
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	// Check if the session has expired
+	if found == nil || found.expiry.Before(s.Now()) {
+		return nil, time.Time{}, 0, nil
+	}
+	return found.data, found.expiry, found.version, nil
+}
+
+func (s *Store) Upsert(ctx context.Context, id string, data []byte, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		sessions, index, err := s.buckets(tx)
+		if err != nil {
+			return err
+		}
+		prev, err := find(sessions, id)
+		if err != nil {
+			return err
+		}
+		next := &session{expiry, 1, data}
+		if prev != nil {
+			next.version = prev.version + 1
+		}
+		return put(sessions, index, id, prev, next)
+	})
+}
+
+// UpsertIfVersion is like Upsert, but returns sesh.ErrConflict if the session
+// has been changed since version.
+func (s *Store) UpsertIfVersion(ctx context.Context, id string, data []byte, expiry time.Time, version int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := s.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		sessions, index, err := s.buckets(tx)
+		if err != nil {
+			return err
+		}
+		prev, err := find(sessions, id)
+		if err != nil {
+			return err
+		}
+		// Expired sessions can be replaced
+		var current int64
+		if prev != nil && !prev.expiry.Before(now) {
+			current = prev.version
+		}
+		if current != version {
+			return sesh.ErrConflict
+		}
+		return put(sessions, index, id, prev, &session{expiry, version + 1, data})
+	})
+}
+
+// Touch updates the expiry of a session without changing its data or version.
+func (s *Store) Touch(ctx context.Context, id string, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := s.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		sessions, index, err := s.buckets(tx)
+		if err != nil {
+			return err
+		}
+		prev, err := find(sessions, id)
+		if err != nil {
+			return err
+		}
+		if prev == nil || prev.expiry.Before(now) {
+			return nil
+		}
+		return put(sessions, index, id, prev, &session{expiry, prev.version, prev.data})
+	})
+}
+
+func (s *Store) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		sessions, index, err := s.buckets(tx)
+		if err != nil {
+			return err
+		}
+		prev, err := find(sessions, id)
+		if err != nil || prev == nil {
+			return err
+		}
+		if err := index.Delete(indexKey(id, prev.expiry)); err != nil {
+			return err
+		}
+		return sessions.Delete([]byte(id))
+	})
+}
+
+// Cleanup removes expired sessions from the store.
+func (s *Store) Cleanup(ctx context.Context) error {
+	_, err := s.cleanup(ctx)
+	return err
+}
+
+// cleanup removes expired sessions in batches, returning the number of sessions
+// removed
+func (s *Store) cleanup(ctx context.Context) (removed int64, err error) {
+	if s.BatchSize <= 0 {
+		return 0, errBatchSize
+	}
+	now := indexKey("", s.Now())
+	for {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		var n int
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			sessions, index, err := s.buckets(tx)
+			if err != nil {
+				return err
+			}
+			// Collect the keys first, since deleting while iterating skips keys
+			var keys [][]byte
+			cursor := index.Cursor()
+			for key, _ := cursor.First(); key != nil && bytes.Compare(key, now) < 0 && len(keys) < s.BatchSize; key, _ = cursor.Next() {
+				keys = append(keys, bytes.Clone(key))
+			}
+			for _, key := range keys {
+				if err := index.Delete(key); err != nil {
+					return err
+				}
+				if err := sessions.Delete(key[8:]); err != nil {
+					return err
+				}
+			}
+			n = len(keys)
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+		removed += int64(n)
+		if n < s.BatchSize {
+			return removed, nil
+		}
+	}
+}
+
+// StartCleanup removes expired sessions every interval in a background
+// goroutine until the context is cancelled. After each cleanup, report is
+// called with the number of sessions removed and any error. Report may be nil.
+// The returned channel is closed once the goroutine has stopped.
+func (s *Store) StartCleanup(ctx context.Context, interval time.Duration, report func(removed int64, err error)) <-chan struct{} {
+	return storeutil.StartCleanup(ctx, interval, s.cleanup, report)
+}
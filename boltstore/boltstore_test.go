@@ -0,0 +1,136 @@
+package boltstore_test
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/boltstore"
+	"github.com/matthewmueller/sesh/storetest"
+	bolt "go.etcd.io/bbolt"
+)
+
+func open(t testing.TB) *bolt.DB {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// count the keys in a bucket
+func count(t testing.TB, db *bolt.DB, bucket string) (n int) {
+	t.Helper()
+	err := db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket([]byte(bucket)).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t testing.TB) sesh.Store {
+		store := boltstore.New(open(t))
+		is.New(t).NoErr(store.Migrate(context.Background()))
+		return store
+	})
+}
+
+func TestMissingBuckets(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := boltstore.New(open(t))
+	_, _, err := store.Find(ctx, "session_token")
+	is.Equal(err.Error(), "boltstore: missing buckets, did you call Migrate?")
+}
+
+func TestCleanup(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	db := open(t)
+	store := boltstore.New(db)
+	is.NoErr(store.Migrate(ctx))
+	err := store.Upsert(ctx, "expired", []byte("data"), time.Now().Add(-time.Minute))
+	is.NoErr(err)
+	err = store.Upsert(ctx, "session_token", []byte("data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	// Touching moves the session within the expiry index
+	err = store.Touch(ctx, "session_token", time.Now().Add(time.Hour))
+	is.NoErr(err)
+	is.Equal(count(t, db, "sessions"), 2)
+	is.Equal(count(t, db, "sessions_expiry"), 2)
+	is.NoErr(store.Cleanup(ctx))
+	is.Equal(count(t, db, "sessions"), 1)
+	is.Equal(count(t, db, "sessions_expiry"), 1)
+	data, _, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "data")
+	// Deleting removes the session from the expiry index
+	is.NoErr(store.Delete(ctx, "session_token"))
+	is.Equal(count(t, db, "sessions"), 0)
+	is.Equal(count(t, db, "sessions_expiry"), 0)
+}
+
+func TestCleanupBatches(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	db := open(t)
+	store := boltstore.New(db)
+	store.BatchSize = 3
+	is.NoErr(store.Migrate(ctx))
+	for i := 0; i < 10; i++ {
+		err := store.Upsert(ctx, "expired"+strconv.Itoa(i), []byte("data"), time.Now().Add(-time.Minute))
+		is.NoErr(err)
+	}
+	err := store.Upsert(ctx, "session_token", []byte("data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	is.NoErr(store.Cleanup(ctx))
+	is.Equal(count(t, db, "sessions"), 1)
+	is.Equal(count(t, db, "sessions_expiry"), 1)
+}
+
+func TestStartCleanup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	is := is.New(t)
+	store := boltstore.New(open(t))
+	store.BatchSize = 3
+	is.NoErr(store.Migrate(ctx))
+	for i := 0; i < 10; i++ {
+		err := store.Upsert(ctx, "expired"+strconv.Itoa(i), []byte("data"), time.Now().Add(-time.Minute))
+		is.NoErr(err)
+	}
+	reports := make(chan int64, 100)
+	done := store.StartCleanup(ctx, time.Millisecond, func(removed int64, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		reports <- removed
+	})
+	is.Equal(<-reports, int64(10))
+	is.Equal(<-reports, int64(0))
+	cancel()
+	<-done
+}
+
+func TestInvalidBatchSize(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := boltstore.New(open(t))
+	is.NoErr(store.Migrate(ctx))
+	is.NoErr(store.Upsert(ctx, "expired", []byte("data"), time.Now().Add(-time.Minute)))
+	for _, size := range []int{0, -1} {
+		store.BatchSize = size
+		err := store.Cleanup(ctx)
+		is.Equal(err.Error(), "boltstore: BatchSize must be greater than 0")
+	}
+}
@@ -0,0 +1,311 @@
+package cachestore
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/internal/storeutil"
+)
+
+// New wraps a store with an in-memory cache. Sessions are read from the cache
+// when possible and written through to the store.
+func New(store sesh.Store) *Store {
+	return &Store{
+		store:      store,
+		MaxEntries: 10000,
+		MaxAge:     5 * time.Second,
+		Now:        time.Now,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+		written:    map[string]uint64{},
+	}
+}
+
+// Store caches sessions in memory in front of another store. Writes go to the
+// underlying store before updating the cache, so the underlying store is always
+// the source of truth.
+//
+// When several servers share the underlying store, a server may serve a
+// cached session for up to MaxAge after another server changed or deleted it.
+type Store struct {
+	// MaxEntries is the maximum number of sessions to cache. When exceeded, the
+	// least recently used session is evicted.
+	MaxEntries int
+
+	// MaxAge is how long a cached session is served before it's read from the
+	// underlying store again. A MaxAge of 0 disables caching reads.
+	MaxAge time.Duration
+
+	// Now is used to get the current time. This is useful for testing.
+	Now func() time.Time
+
+	store   sesh.Store
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // Most recently used at the front
+	// seq numbers the writes, and written holds the seq of the latest write to
+	// each session, so reads that raced with a write to the same session don't
+	// cache it. Once written grows past MaxEntries, it's cleared and forgotten
+	// holds the seq it was cleared at.
+	seq       uint64
+	written   map[string]uint64
+	forgotten uint64
+}
+
+var _ sesh.Store = (*Store)(nil)
+var _ sesh.Toucher = (*Store)(nil)
+var _ sesh.VersionedStore = (*Store)(nil)
+var _ sesh.Lister = (*Store)(nil)
+
+type entry struct {
+	id     string
+	data   []byte
+	expiry time.Time
+	// version of the session in a versioned store, or 0 if it's unknown
+	version  int64
+	cachedAt time.Time
+}
+
+// get the cached session, removing it if it's stale or expired. Must be called
+// with the lock.
+func (s *Store) get(id string, now time.Time) (*entry, bool) {
+	el, ok := s.entries[id]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if e.expiry.Before(now) || now.Sub(e.cachedAt) >= s.MaxAge {
+		s.remove(el)
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	return e, true
+}
+
+// set the cached session, evicting the least recently used sessions if there
+// are too many. Must be called with the lock.
+func (s *Store) set(e *entry) {
+	if s.MaxAge <= 0 || s.MaxEntries <= 0 {
+		return
+	}
+	if el, ok := s.entries[e.id]; ok {
+		el.Value = e
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.entries[e.id] = s.lru.PushFront(e)
+	for s.lru.Len() > s.MaxEntries {
+		s.remove(s.lru.Back())
+	}
+}
+
+// remove the cached session. Must be called with the lock.
+func (s *Store) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*entry).id)
+}
+
+// begin a write to the session, returning its seq. Must be called with the
+// lock.
+func (s *Store) begin(id string) uint64 {
+	if len(s.written) >= s.MaxEntries {
+		s.written = map[string]uint64{}
+		s.forgotten = s.seq
+	}
+	s.seq++
+	s.written[id] = s.seq
+	return s.seq
+}
+
+// latest returns true if no write to the session began after seq. Must be
+// called with the lock.
+func (s *Store) latest(id string, seq uint64) bool {
+	return seq >= s.forgotten && s.written[id] <= seq
+}
+
+// invalidate begins a write to the session and removes it from the cache.
+// Must be called with the lock.
+func (s *Store) invalidate(id string) uint64 {
+	seq := s.begin(id)
+	if el, ok := s.entries[id]; ok {
+		s.remove(el)
+	}
+	return seq
+}
+
+// Find the session in the cache, falling back to the underlying store
+func (s *Store) Find(ctx context.Context, id string) (data []byte, expiry time.Time, err error) {
+	data, expiry, _, err = s.find(ctx, id, nil)
+	return data, expiry, err
+}
+
+// FindVersion is like Find, but also returns the version of the session.
+// Cached sessions are only used if their version is known. It returns
+// errors.ErrUnsupported if the underlying store isn't versioned.
+func (s *Store) FindVersion(ctx context.Context, id string) (data []byte, expiry time.Time, version int64, err error) {
+	versioned, ok := s.store.(sesh.VersionedStore)
+	if !ok {
+		return nil, time.Time{}, 0, errors.ErrUnsupported
+	}
+	return s.find(ctx, id, versioned)
+}
+
+// find the session in the cache, falling back to the underlying store. When
+// versioned isn't nil, the version is needed, so cached sessions with an
+// unknown version are read again.
+func (s *Store) find(ctx context.Context, id string, versioned sesh.VersionedStore) (data []byte, expiry time.Time, version int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	now := s.Now()
+	s.mu.Lock()
+	if e, ok := s.get(id, now); ok && (versioned == nil || e.version > 0) {
+		s.mu.Unlock()
+		return e.data, e.expiry, e.version, nil
+	}
+	seq := s.seq
+	s.mu.Unlock()
+	if versioned != nil {
+		data, expiry, version, err = versioned.FindVersion(ctx, id)
+	} else {
+		data, expiry, version, err = s.load(ctx, id)
+	}
+	if err != nil || data == nil {
+		return data, expiry, version, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.latest(id, seq) {
+		s.set(&entry{id, data, expiry, version, now})
+	}
+	return data, expiry, version, nil
+}
+
+// load the session from the underlying store, along with its version when the
+// store is versioned
+func (s *Store) load(ctx context.Context, id string) (data []byte, expiry time.Time, version int64, err error) {
+	if versioned, ok := s.store.(sesh.VersionedStore); ok {
+		data, expiry, version, err = versioned.FindVersion(ctx, id)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return data, expiry, version, err
+		}
+	}
+	data, expiry, err = s.store.Find(ctx, id)
+	return data, expiry, 0, err
+}
+
+// Upsert writes the session to the underlying store, then caches it
+func (s *Store) Upsert(ctx context.Context, id string, data []byte, expiry time.Time) error {
+	s.mu.Lock()
+	seq := s.invalidate(id)
+	s.mu.Unlock()
+	if err := s.store.Upsert(ctx, id, data, expiry); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Another write to the session began meanwhile and may have finished
+	// first, so let the next read decide
+	if !s.latest(id, seq) {
+		s.invalidate(id)
+		return nil
+	}
+	// The version is unknown, since the session may have been written before
+	s.set(&entry{id, bytes.Clone(data), expiry, 0, s.Now()})
+	return nil
+}
+
+// UpsertIfVersion is like Upsert, but returns sesh.ErrConflict if the session
+// has been changed since version. It returns errors.ErrUnsupported if the
+// underlying store isn't versioned.
+func (s *Store) UpsertIfVersion(ctx context.Context, id string, data []byte, expiry time.Time, version int64) error {
+	versioned, ok := s.store.(sesh.VersionedStore)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	s.mu.Lock()
+	seq := s.invalidate(id)
+	s.mu.Unlock()
+	if err := versioned.UpsertIfVersion(ctx, id, data, expiry, version); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.latest(id, seq) {
+		s.invalidate(id)
+		return nil
+	}
+	s.set(&entry{id, bytes.Clone(data), expiry, version + 1, s.Now()})
+	return nil
+}
+
+// Delete the session from the underlying store and the cache
+func (s *Store) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	s.invalidate(id)
+	s.mu.Unlock()
+	err := s.store.Delete(ctx, id)
+	s.mu.Lock()
+	s.invalidate(id)
+	s.mu.Unlock()
+	return err
+}
+
+// Touch updates the expiry in the underlying store, then updates the cached
+// session, so sliding expiry still reads from the cache.
+func (s *Store) Touch(ctx context.Context, id string, expiry time.Time) error {
+	s.mu.Lock()
+	// Reads that started before the touch shouldn't cache the old expiry
+	seq := s.begin(id)
+	s.mu.Unlock()
+	if err := storeutil.Touch(ctx, s.store, id, expiry); err != nil {
+		s.mu.Lock()
+		s.invalidate(id)
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[id]
+	if !ok {
+		return nil
+	}
+	// Another write to the session began meanwhile and may have finished
+	// first, so let the next read decide
+	if !s.latest(id, seq) {
+		s.invalidate(id)
+		return nil
+	}
+	// Replace the entry rather than changing it, since reads return its fields
+	touched := *el.Value.(*entry)
+	touched.expiry = expiry
+	// Without a Toucher, the session was rewritten, changing its version
+	if _, ok := s.store.(sesh.Toucher); !ok {
+		touched.version = 0
+	}
+	el.Value = &touched
+	return nil
+}
+
+// Len returns the number of cached sessions, including stale and expired
+// sessions that haven't been removed yet.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// List the sessions in the underlying store. It returns errors.ErrUnsupported
+// if the underlying store doesn't implement sesh.Lister.
+func (s *Store) List(ctx context.Context, fn func(id string) error) error {
+	lister, ok := s.store.(sesh.Lister)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return lister.List(ctx, fn)
+}
@@ -0,0 +1,246 @@
+package cachestore_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/cachestore"
+	"github.com/matthewmueller/sesh/filestore"
+	"github.com/matthewmueller/sesh/mockstore"
+	"github.com/matthewmueller/sesh/storetest"
+)
+
+// countingStore counts the number of finds that reach the underlying store
+type countingStore struct {
+	*sesh.MemoryStore
+	finds int
+}
+
+func (c *countingStore) Find(ctx context.Context, id string) ([]byte, time.Time, error) {
+	c.finds++
+	return c.MemoryStore.Find(ctx, id)
+}
+
+func (c *countingStore) FindVersion(ctx context.Context, id string) ([]byte, time.Time, int64, error) {
+	c.finds++
+	return c.MemoryStore.FindVersion(ctx, id)
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t testing.TB) sesh.Store {
+		return cachestore.New(sesh.NewMemoryStore())
+	})
+}
+
+func TestCached(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	backing := &countingStore{MemoryStore: sesh.NewMemoryStore()}
+	store := cachestore.New(backing)
+	err := backing.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	for i := 0; i < 3; i++ {
+		data, _, err := store.Find(ctx, "session_token")
+		is.NoErr(err)
+		is.Equal(string(data), "encoded_data")
+	}
+	is.Equal(backing.finds, 1)
+	// Writes are cached
+	err = store.Upsert(ctx, "session_token", []byte("new_encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	data, _, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "new_encoded_data")
+	is.Equal(backing.finds, 1)
+	// Missing sessions aren't cached
+	for i := 0; i < 2; i++ {
+		data, _, err = store.Find(ctx, "missing")
+		is.NoErr(err)
+		is.Equal(data, nil)
+	}
+	is.Equal(backing.finds, 3)
+}
+
+func TestCachedWhileWriting(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	memory := sesh.NewMemoryStore()
+	err := memory.Upsert(ctx, "a", []byte("a_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	var store *cachestore.Store
+	finds := 0
+	backing := mockstore.New()
+	backing.MockUpsert = memory.Upsert
+	backing.MockFind = func(ctx context.Context, id string) ([]byte, time.Time, error) {
+		finds++
+		// Another session is written while this one is being read
+		if id == "a" && finds == 1 {
+			err := store.Upsert(ctx, "b", []byte("b_data"), time.Now().Add(time.Minute))
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+		}
+		return memory.Find(ctx, id)
+	}
+	store = cachestore.New(backing)
+	// Writing one session doesn't stop other sessions from being cached
+	for i := 0; i < 3; i++ {
+		data, _, err := store.Find(ctx, "a")
+		is.NoErr(err)
+		is.Equal(string(data), "a_data")
+	}
+	is.Equal(finds, 1)
+}
+
+func TestMaxAge(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	backing := &countingStore{MemoryStore: sesh.NewMemoryStore()}
+	store := cachestore.New(backing)
+	now := time.Now()
+	store.Now = func() time.Time { return now }
+	store.MaxAge = time.Second
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), now.Add(time.Minute))
+	is.NoErr(err)
+	// Another server changes the session
+	err = backing.Upsert(ctx, "session_token", []byte("changed_data"), now.Add(time.Minute))
+	is.NoErr(err)
+	data, _, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	is.Equal(backing.finds, 0)
+	// The cached session is stale
+	now = now.Add(time.Second)
+	data, _, err = store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "changed_data")
+	is.Equal(backing.finds, 1)
+}
+
+func TestExpired(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	backing := &countingStore{MemoryStore: sesh.NewMemoryStore()}
+	store := cachestore.New(backing)
+	now := time.Now()
+	store.Now = func() time.Time { return now }
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), now.Add(time.Second))
+	is.NoErr(err)
+	now = now.Add(2 * time.Second)
+	backing.Now = func() time.Time { return now }
+	data, expiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.True(expiry.IsZero())
+	is.Equal(store.Len(), 0)
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	backing := &countingStore{MemoryStore: sesh.NewMemoryStore()}
+	store := cachestore.New(backing)
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	is.Equal(store.Len(), 1)
+	is.NoErr(store.Delete(ctx, "session_token"))
+	is.Equal(store.Len(), 0)
+	data, _, err := backing.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+}
+
+func TestMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	backing := &countingStore{MemoryStore: sesh.NewMemoryStore()}
+	store := cachestore.New(backing)
+	store.MaxEntries = 2
+	for i := 0; i < 3; i++ {
+		err := store.Upsert(ctx, "s"+strconv.Itoa(i), []byte("data"), time.Now().Add(time.Minute))
+		is.NoErr(err)
+	}
+	is.Equal(store.Len(), 2)
+	// The least recently used session was evicted, but is still in the store
+	data, _, err := store.Find(ctx, "s0")
+	is.NoErr(err)
+	is.Equal(string(data), "data")
+	is.Equal(backing.finds, 1)
+	is.Equal(backing.Len(), 3)
+}
+
+func TestTouch(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	backing := &countingStore{MemoryStore: sesh.NewMemoryStore()}
+	store := cachestore.New(backing)
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	newExpiry := time.Now().Add(time.Hour)
+	is.NoErr(store.Touch(ctx, "session_token", newExpiry))
+	// The cached session is updated rather than read again
+	data, expiry, version, err := store.FindVersion(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	is.Equal(expiry.Unix(), newExpiry.Unix())
+	is.Equal(version, int64(1))
+	is.Equal(backing.finds, 1)
+	for i := 0; i < 2; i++ {
+		is.NoErr(store.Touch(ctx, "session_token", newExpiry.Add(time.Duration(i+1)*time.Minute)))
+		_, expiry, _, err = store.FindVersion(ctx, "session_token")
+		is.NoErr(err)
+		is.Equal(expiry.Unix(), newExpiry.Add(time.Duration(i+1)*time.Minute).Unix())
+	}
+	is.Equal(backing.finds, 1)
+	_, expiry, err = backing.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(expiry.Unix(), newExpiry.Add(2*time.Minute).Unix())
+}
+
+func TestVersioned(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	backing := &countingStore{MemoryStore: sesh.NewMemoryStore()}
+	store := cachestore.New(backing)
+	err := store.UpsertIfVersion(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute), 0)
+	is.NoErr(err)
+	// Versioned writes are cached with their version
+	data, _, version, err := store.FindVersion(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	is.Equal(version, int64(1))
+	is.Equal(backing.finds, 0)
+	// Plain writes don't know the version, so it's read again
+	err = store.Upsert(ctx, "session_token", []byte("new_encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	for i := 0; i < 2; i++ {
+		data, _, version, err = store.FindVersion(ctx, "session_token")
+		is.NoErr(err)
+		is.Equal(string(data), "new_encoded_data")
+		is.Equal(version, int64(2))
+	}
+	is.Equal(backing.finds, 1)
+	// Conflicts aren't cached
+	err = store.UpsertIfVersion(ctx, "session_token", []byte("stale_data"), time.Now().Add(time.Minute), 1)
+	is.True(errors.Is(err, sesh.ErrConflict))
+	data, _, err = store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "new_encoded_data")
+}
+
+func TestUnsupported(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := cachestore.New(filestore.New(t.TempDir()))
+	_, _, _, err := store.FindVersion(ctx, "session_token")
+	is.True(errors.Is(err, errors.ErrUnsupported))
+	err = store.UpsertIfVersion(ctx, "session_token", []byte("data"), time.Now().Add(time.Minute), 0)
+	is.True(errors.Is(err, errors.ErrUnsupported))
+	err = store.List(ctx, func(id string) error { return nil })
+	is.True(errors.Is(err, errors.ErrUnsupported))
+}
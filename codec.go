@@ -2,17 +2,28 @@ package sesh
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
 )
 
+// Codec encodes and decodes session data for the store
 type Codec interface {
 	Encode(v any) ([]byte, error)
 	Decode(data []byte, v any) error
 }
 
-type gobCodec struct{}
+// GobCodec encodes session data using encoding/gob. This is the default codec.
+// Interface fields must be registered with gob.Register.
+type GobCodec struct{}
 
-func (gobCodec) Encode(v any) ([]byte, error) {
+var _ Codec = GobCodec{}
+
+func (GobCodec) Encode(v any) ([]byte, error) {
 	b := new(bytes.Buffer)
 	enc := gob.NewEncoder(b)
 	if err := enc.Encode(v); err != nil {
@@ -21,7 +32,7 @@ func (gobCodec) Encode(v any) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-func (gobCodec) Decode(data []byte, v any) error {
+func (GobCodec) Decode(data []byte, v any) error {
 	b := bytes.NewBuffer(data)
 	dec := gob.NewDecoder(b)
 	if err := dec.Decode(v); err != nil {
@@ -29,3 +40,208 @@ func (gobCodec) Decode(data []byte, v any) error {
 	}
 	return nil
 }
+
+// JSONCodec encodes session data using encoding/json. JSON sessions can be
+// inspected with database tooling and read by services not written in Go. The
+// session data is stored in the "data" field of a JSON object alongside the
+// session's metadata:
+//
+//	{"sesh":1,"created":"2080-01-01T00:00:00Z","schema":0,"data":{"UserID":7}}
+type JSONCodec struct {
+	// DisallowUnknownFields causes decoding to fail when the stored session has
+	// fields that don't exist in the session data.
+	DisallowUnknownFields bool
+
+	// UseNumber decodes numbers into interface fields as json.Number instead of
+	// float64.
+	UseNumber bool
+}
+
+var _ Codec = JSONCodec{}
+
+func (JSONCodec) Encode(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c JSONCodec) Decode(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if c.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if c.UseNumber {
+		dec.UseNumber()
+	}
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	return nil
+}
+
+// jsonCodec returns the codec that encodes sessions as plain JSON, if there is
+// one. A VersionedCodec doesn't tag JSON sessions, since they're stored in JSON
+// records that can't be confused with sessions in other formats.
+func jsonCodec(codec Codec) (Codec, bool) {
+	switch c := codec.(type) {
+	case JSONCodec, *JSONCodec:
+		return c, true
+	case *VersionedCodec:
+		return jsonCodec(c.Codec)
+	default:
+		return nil, false
+	}
+}
+
+// jsonDecoder returns the codec that decodes sessions stored in JSON records.
+// A VersionedCodec that has moved on from JSON decodes them with the JSONCodec
+// in its older formats.
+func jsonDecoder(codec Codec) (Codec, bool) {
+	if c, ok := jsonCodec(codec); ok {
+		return c, true
+	}
+	v, ok := codec.(*VersionedCodec)
+	if !ok {
+		return nil, false
+	}
+	formats := make([]string, 0, len(v.Formats))
+	for format := range v.Formats {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	for _, format := range formats {
+		if c, ok := jsonCodec(v.Formats[format]); ok {
+			return c, true
+		}
+	}
+	return jsonCodec(v.Untagged)
+}
+
+// VersionedCodec prefixes encoded session data with a short header naming its
+// format. Sessions stored in older formats can still be decoded, so you can
+// switch codecs or session data shapes without logging everyone out.
+//
+// When Codec is a JSONCodec, sessions are stored as plain JSON without the
+// header, just like with a JSONCodec on its own. Once the sessions stored in
+// older formats have expired, you can replace the VersionedCodec with the
+// JSONCodec.
+type VersionedCodec struct {
+	// Format is the name of the current format (e.g. "json" or "v2"). It must be
+	// between 1 and 255 bytes.
+	Format string
+
+	// Codec encodes and decodes the current format
+	Codec Codec
+
+	// Formats contains codecs for older formats by name
+	Formats map[string]Codec
+
+	// Untagged decodes sessions stored without a header, before VersionedCodec
+	// was used. Typically this is the codec you're migrating from.
+	Untagged Codec
+}
+
+var _ Codec = (*VersionedCodec)(nil)
+
+// versionMagic can't be confused with the start of a gob or JSON payload
+var versionMagic = []byte{0x00, 'v'}
+
+func (c *VersionedCodec) Encode(v any) ([]byte, error) {
+	if len(c.Format) == 0 || len(c.Format) > 255 {
+		return nil, fmt.Errorf("sesh: invalid codec format %q", c.Format)
+	}
+	data, err := c.Codec.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(versionMagic)+1+len(c.Format)+len(data))
+	out = append(out, versionMagic...)
+	out = append(out, byte(len(c.Format)))
+	out = append(out, c.Format...)
+	out = append(out, data...)
+	return out, nil
+}
+
+func (c *VersionedCodec) Decode(data []byte, v any) error {
+	if !bytes.HasPrefix(data, versionMagic) {
+		if c.Untagged == nil {
+			return errors.New("sesh: session is missing a codec format")
+		}
+		return c.Untagged.Decode(data, v)
+	}
+	data = data[len(versionMagic):]
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return errors.New("sesh: invalid codec format")
+	}
+	format, data := string(data[1:1+int(data[0])]), data[1+int(data[0]):]
+	if format == c.Format {
+		return c.Codec.Decode(data, v)
+	}
+	codec, ok := c.Formats[format]
+	if !ok {
+		return fmt.Errorf("sesh: unknown codec format %q", format)
+	}
+	return codec.Decode(data, v)
+}
+
+// CompressCodec compresses encoded session data with gzip once it's larger
+// than MinSize. Compressed sessions are marked, so small sessions are stored
+// as-is and sessions stored before compression was enabled can still be read.
+type CompressCodec struct {
+	// Codec encodes and decodes the session data
+	Codec Codec
+
+	// MinSize is the minimum size in bytes of encoded session data before it's
+	// compressed. The default value of 0 compresses all sessions.
+	MinSize int
+
+	// Level is the gzip compression level. The default value of 0 uses
+	// gzip.DefaultCompression.
+	Level int
+}
+
+var _ Codec = (*CompressCodec)(nil)
+
+// compressMagic can't be confused with the start of a gob or JSON payload
+var compressMagic = []byte{0x00, 'z'}
+
+func (c *CompressCodec) Encode(v any) ([]byte, error) {
+	data, err := c.Codec.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < c.MinSize {
+		return data, nil
+	}
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	b := new(bytes.Buffer)
+	b.Write(compressMagic)
+	zw, err := gzip.NewWriterLevel(b, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (c *CompressCodec) Decode(data []byte, v any) error {
+	if !bytes.HasPrefix(data, compressMagic) {
+		return c.Codec.Decode(data, v)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data[len(compressMagic):]))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	data, err = io.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+	return c.Codec.Decode(data, v)
+}
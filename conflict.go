@@ -0,0 +1,92 @@
+package sesh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrRetry can be returned from Manager.Conflict to run the handler again with
+// the latest session. The response from the previous run is discarded and the
+// request body is read again from the start. Handlers that flushed the response
+// can't be retried, since the response has already been sent.
+var ErrRetry = errors.New("sesh: retry the request")
+
+var errFlushed = errors.New("sesh: can't retry the request after the response was flushed")
+
+// maxAttempts is the maximum number of times we'll try to save a session or
+// run a handler before giving up because of conflicts
+const maxAttempts = 3
+
+// upsert the session into the store. When the store is versioned and the
+// manager has a conflict handler, concurrent changes are detected and resolved.
+// Returns the raw session that was stored.
+func (m *Manager[Data]) upsert(ctx context.Context, session *Session[*Data], raw []byte) ([]byte, error) {
+	store, ok := m.Store.(VersionedStore)
+	if !ok || m.Conflict == nil {
+		return raw, m.Store.Upsert(ctx, session.ID, raw, session.Expiry)
+	}
+	for attempt := 1; ; attempt++ {
+		err := store.UpsertIfVersion(ctx, session.ID, raw, session.Expiry, session.version)
+		if err == nil {
+			session.version++
+			return raw, nil
+		} else if errors.Is(err, errors.ErrUnsupported) {
+			// The store wraps a store that isn't versioned
+			return raw, m.Store.Upsert(ctx, session.ID, raw, session.Expiry)
+		} else if !errors.Is(err, ErrConflict) || attempt == maxAttempts {
+			return nil, err
+		}
+		// Load the latest session and merge in our changes
+		latestRaw, _, version, err := store.FindVersion(ctx, session.ID)
+		if err != nil {
+			return nil, err
+		}
+		// The session was removed by another request
+		if latestRaw == nil {
+			return nil, ErrConflict
+		}
+		rec, err := decodeRecord(latestRaw)
+		if err != nil {
+			return nil, err
+		}
+		latest, err := m.decode(rec)
+		if err != nil {
+			return nil, err
+		}
+		data, err := m.Conflict(latest, session.Data)
+		if err != nil {
+			return nil, err
+		}
+		session.Data = data
+		session.version = version
+		if raw, err = m.encode(session); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryBody records what the handler reads from the request body, so it can be
+// read again when the handler is retried. Close is a no-op, since the server
+// closes the request body once the middleware returns.
+type retryBody struct {
+	r    io.Reader
+	read bytes.Buffer
+}
+
+func (b *retryBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read.Write(p[:n])
+	return n, err
+}
+
+func (b *retryBody) Close() error {
+	return nil
+}
+
+// rewind returns a body that reads what's been read so far, followed by the
+// rest of the body
+func (b *retryBody) rewind() *retryBody {
+	return &retryBody{r: io.MultiReader(bytes.NewReader(b.read.Bytes()), b.r)}
+}
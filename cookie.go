@@ -1,6 +1,8 @@
 package sesh
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 )
@@ -27,6 +29,11 @@ type Cookie struct {
 	// path that the cookie was issued from.
 	Path string
 
+	// ExpireIn sets how long a new session lasts before it expires. This is used
+	// for both the session in the store and the 'Expires' attribute on the
+	// session cookie. The default value is 7 days.
+	ExpireIn time.Duration
+
 	// Persist sets whether the session cookie should be persistent or not
 	// (i.e. whether it should be retained after a user closes their browser).
 	// The default value is true, which means that the session cookie will not
@@ -34,8 +41,8 @@ type Cookie struct {
 	// 'Expires' and 'MaxAge' values will be added to the session cookie. If you
 	// want to only persist some sessions (rather than all of them), then set this
 	// to false and call the RememberMe() method for the specific sessions that you
-	// want to persist.
-	ExpireIn time.Duration
+	// want to persist. Sessions still expire in the store after ExpireIn.
+	Persist bool
 
 	// SameSite controls the value of the 'SameSite' attribute on the session
 	// cookie. By default this is set to 'SameSite=Lax'. If you want no SameSite
@@ -47,4 +54,67 @@ type Cookie struct {
 	// requests over HTTPS in production environments.
 	// See https://github.com/OWASP/CheatSheetSeries/blob/master/cheatsheets/Session_Management_Cheat_Sheet.md#transport-layer-security.
 	Secure bool
+
+	// Partitioned sets the 'Partitioned' attribute on the session cookie, which
+	// stores the cookie separately for each top-level site (CHIPS). This is
+	// useful for sessions in embedded third-party contexts. Partitioned cookies
+	// must also be Secure. The default value is false.
+	Partitioned bool
+
+	// MaxAge sets the 'Max-Age' attribute alongside the 'Expires' attribute on
+	// the session cookie. Max-Age is relative to when the cookie is received, so
+	// it isn't affected by clock skew between the server and the browser. The
+	// default value is false.
+	MaxAge bool
+}
+
+// Validate the cookie settings
+func (c *Cookie) Validate() error {
+	if c.Name == "" {
+		return errors.New("sesh: cookie name must not be empty")
+	}
+	if err := (&http.Cookie{Name: c.Name}).Valid(); err != nil {
+		return fmt.Errorf("sesh: invalid cookie name %q: %w", c.Name, err)
+	}
+	if c.ExpireIn < 0 {
+		return errors.New("sesh: cookie expiry must not be negative")
+	}
+	if c.SameSite == http.SameSiteNoneMode && !c.Secure {
+		return errors.New("sesh: cookies with SameSite=None must be Secure")
+	}
+	if c.Partitioned && !c.Secure {
+		return errors.New("sesh: partitioned cookies must be Secure")
+	}
+	return nil
+}
+
+// cookie creates a session cookie with the configured attributes. A zero
+// expiry creates a browser session cookie.
+func (c *Cookie) cookie(value string, expiry, now time.Time) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:        c.Name,
+		Value:       value,
+		Expires:     expiry,
+		Domain:      c.Domain,
+		Path:        c.Path,
+		HttpOnly:    c.HttpOnly,
+		Secure:      c.Secure,
+		SameSite:    c.SameSite,
+		Partitioned: c.Partitioned,
+	}
+	if c.MaxAge && !expiry.IsZero() {
+		cookie.MaxAge = int(expiry.Sub(now).Seconds())
+		// A Max-Age of 0 means no attribute, so expire the cookie instead
+		if cookie.MaxAge <= 0 {
+			cookie.MaxAge = -1
+		}
+	}
+	return cookie
+}
+
+// expired creates a cookie that removes the session cookie from the browser
+func (c *Cookie) expired() *http.Cookie {
+	cookie := c.cookie("", time.Time{}, time.Time{})
+	cookie.MaxAge = -1
+	return cookie
 }
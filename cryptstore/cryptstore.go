@@ -0,0 +1,174 @@
+package cryptstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/internal/storeutil"
+)
+
+// New wraps a store, encrypting session data at rest with AES-GCM. The first
+// key encrypts sessions, while every key is tried when decrypting, so you can
+// rotate keys by adding a new key to the front. Keys must be 16, 24 or 32 bytes
+// long to select AES-128, AES-192 or AES-256.
+func New(store sesh.Store, keys ...[]byte) (*Store, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("cryptstore: at least one key is required")
+	}
+	s := &Store{store: store}
+	for _, k := range keys {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(k)
+		s.keys = append(s.keys, &key{sum[:keyIDSize], aead})
+	}
+	return s, nil
+}
+
+// Store encrypts session data before it's written to the underlying store and
+// decrypts it when it's read back. The session id is authenticated alongside
+// the data, so encrypted data can't be moved between sessions.
+type Store struct {
+	store sesh.Store
+	keys  []*key
+}
+
+var _ sesh.Store = (*Store)(nil)
+var _ sesh.Toucher = (*Store)(nil)
+var _ sesh.VersionedStore = (*Store)(nil)
+var _ sesh.Lister = (*Store)(nil)
+
+type key struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// Encrypted data is stored as: version | key id | nonce | ciphertext
+const (
+	version   byte = 1
+	keyIDSize      = 4
+)
+
+func (s *Store) encrypt(id string, data []byte) ([]byte, error) {
+	k := s.keys[0]
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, 1+keyIDSize+len(nonce)+len(data)+k.aead.Overhead())
+	out = append(out, version)
+	out = append(out, k.id...)
+	out = append(out, nonce...)
+	return k.aead.Seal(out, nonce, data, []byte(id)), nil
+}
+
+func (s *Store) decrypt(id string, data []byte) ([]byte, bool) {
+	if len(data) < 1+keyIDSize || data[0] != version {
+		return nil, false
+	}
+	keyID, data := data[1:1+keyIDSize], data[1+keyIDSize:]
+	for _, k := range s.keys {
+		if !bytes.Equal(k.id, keyID) {
+			continue
+		}
+		if len(data) < k.aead.NonceSize() {
+			return nil, false
+		}
+		nonce, ciphertext := data[:k.aead.NonceSize()], data[k.aead.NonceSize():]
+		plaintext, err := k.aead.Open(nil, nonce, ciphertext, []byte(id))
+		if err != nil {
+			return nil, false
+		}
+		return plaintext, true
+	}
+	return nil, false
+}
+
+// Find and decrypt the session data. Sessions that can't be decrypted, either
+// because they've been tampered with or because their key is no longer in the
+// key ring, are treated as missing.
+func (s *Store) Find(ctx context.Context, id string) (data []byte, expiry time.Time, err error) {
+	data, expiry, err = s.store.Find(ctx, id)
+	if err != nil || data == nil {
+		return nil, time.Time{}, err
+	}
+	plaintext, ok := s.decrypt(id, data)
+	if !ok {
+		return nil, time.Time{}, nil
+	}
+	return plaintext, expiry, nil
+}
+
+// Upsert encrypts the session data with the current key
+func (s *Store) Upsert(ctx context.Context, id string, data []byte, expiry time.Time) error {
+	ciphertext, err := s.encrypt(id, data)
+	if err != nil {
+		return err
+	}
+	return s.store.Upsert(ctx, id, ciphertext, expiry)
+}
+
+// FindVersion is like Find, but also returns the version of the session. It
+// returns errors.ErrUnsupported if the underlying store isn't versioned.
+func (s *Store) FindVersion(ctx context.Context, id string) (data []byte, expiry time.Time, version int64, err error) {
+	versioned, ok := s.store.(sesh.VersionedStore)
+	if !ok {
+		return nil, time.Time{}, 0, errors.ErrUnsupported
+	}
+	data, expiry, version, err = versioned.FindVersion(ctx, id)
+	if err != nil || data == nil {
+		return nil, time.Time{}, 0, err
+	}
+	plaintext, ok := s.decrypt(id, data)
+	if !ok {
+		return nil, time.Time{}, 0, nil
+	}
+	return plaintext, expiry, version, nil
+}
+
+// UpsertIfVersion is like Upsert, but returns sesh.ErrConflict if the session
+// has been changed since version. It returns errors.ErrUnsupported if the
+// underlying store isn't versioned.
+func (s *Store) UpsertIfVersion(ctx context.Context, id string, data []byte, expiry time.Time, version int64) error {
+	versioned, ok := s.store.(sesh.VersionedStore)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	ciphertext, err := s.encrypt(id, data)
+	if err != nil {
+		return err
+	}
+	return versioned.UpsertIfVersion(ctx, id, ciphertext, expiry, version)
+}
+
+func (s *Store) Delete(ctx context.Context, id string) error {
+	return s.store.Delete(ctx, id)
+}
+
+// Touch updates the expiry without re-encrypting the session data
+func (s *Store) Touch(ctx context.Context, id string, expiry time.Time) error {
+	return storeutil.Touch(ctx, s.store, id, expiry)
+}
+
+// List the sessions in the underlying store. It returns errors.ErrUnsupported
+// if the underlying store doesn't implement sesh.Lister.
+func (s *Store) List(ctx context.Context, fn func(id string) error) error {
+	lister, ok := s.store.(sesh.Lister)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return lister.List(ctx, fn)
+}
@@ -0,0 +1,233 @@
+package cryptstore_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/cryptstore"
+	"github.com/matthewmueller/sesh/filestore"
+	"github.com/matthewmueller/sesh/storetest"
+)
+
+var (
+	key1 = bytes.Repeat([]byte("1"), 32)
+	key2 = bytes.Repeat([]byte("2"), 32)
+)
+
+func TestUpsertFind(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	backing := sesh.NewMemoryStore()
+	store, err := cryptstore.New(backing, key1)
+	is.NoErr(err)
+	inputData := []byte("encoded_data")
+	inputExpiry := time.Now().Add(time.Minute)
+	err = store.Upsert(ctx, "session_token", inputData, inputExpiry)
+	is.NoErr(err)
+	actualData, actualExpiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(actualData), string(inputData))
+	is.Equal(actualExpiry.Unix(), inputExpiry.Unix())
+	// The data is encrypted in the backing store
+	encrypted, _, err := backing.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.True(!bytes.Contains(encrypted, inputData))
+}
+
+func TestFindMissing(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store, err := cryptstore.New(sesh.NewMemoryStore(), key1)
+	is.NoErr(err)
+	data, expiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.True(expiry.IsZero())
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store, err := cryptstore.New(sesh.NewMemoryStore(), key1)
+	is.NoErr(err)
+	err = store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	is.NoErr(store.Delete(ctx, "session_token"))
+	data, expiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.True(expiry.IsZero())
+}
+
+func TestTampered(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	backing := sesh.NewMemoryStore()
+	store, err := cryptstore.New(backing, key1)
+	is.NoErr(err)
+	expiry := time.Now().Add(time.Minute)
+	err = store.Upsert(ctx, "session_token", []byte("encoded_data"), expiry)
+	is.NoErr(err)
+	encrypted, _, err := backing.Find(ctx, "session_token")
+	is.NoErr(err)
+	// Encrypted data can't be moved to another session
+	is.NoErr(backing.Upsert(ctx, "other_token", encrypted, expiry))
+	data, _, err := store.Find(ctx, "other_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	// Modified data can't be decrypted
+	tampered := bytes.Clone(encrypted)
+	tampered[len(tampered)-1] ^= 1
+	is.NoErr(backing.Upsert(ctx, "session_token", tampered, expiry))
+	data, _, err = store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	// Plaintext data can't be read
+	is.NoErr(backing.Upsert(ctx, "session_token", []byte("encoded_data"), expiry))
+	data, _, err = store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+}
+
+func TestRotate(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	backing := sesh.NewMemoryStore()
+	expiry := time.Now().Add(time.Minute)
+	store1, err := cryptstore.New(backing, key1)
+	is.NoErr(err)
+	is.NoErr(store1.Upsert(ctx, "s1", []byte("data1"), expiry))
+	// Rotate to key2, keeping key1 to decrypt existing sessions
+	store2, err := cryptstore.New(backing, key2, key1)
+	is.NoErr(err)
+	data, _, err := store2.Find(ctx, "s1")
+	is.NoErr(err)
+	is.Equal(string(data), "data1")
+	is.NoErr(store2.Upsert(ctx, "s2", []byte("data2"), expiry))
+	// Once key1 is removed, old sessions can no longer be decrypted
+	store3, err := cryptstore.New(backing, key2)
+	is.NoErr(err)
+	data, _, err = store3.Find(ctx, "s1")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	data, _, err = store3.Find(ctx, "s2")
+	is.NoErr(err)
+	is.Equal(string(data), "data2")
+}
+
+func TestTouch(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store, err := cryptstore.New(sesh.NewMemoryStore(), key1)
+	is.NoErr(err)
+	err = store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	newExpiry := time.Now().Add(time.Hour)
+	is.NoErr(store.Touch(ctx, "session_token", newExpiry))
+	data, expiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	is.Equal(expiry.Unix(), newExpiry.Unix())
+}
+
+func TestInvalidKey(t *testing.T) {
+	is := is.New(t)
+	_, err := cryptstore.New(sesh.NewMemoryStore())
+	is.Equal(err.Error(), "cryptstore: at least one key is required")
+	_, err = cryptstore.New(sesh.NewMemoryStore(), []byte("short"))
+	is.Equal(err.Error(), "crypto/aes: invalid key size 5")
+}
+
+func TestSession(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	type Data struct {
+		UserID int
+	}
+	store, err := cryptstore.New(sesh.NewMemoryStore(), key1)
+	is.NoErr(err)
+	sessions := sesh.New[Data]()
+	sessions.Store = store
+	session, err := sessions.Load(ctx, "")
+	is.NoErr(err)
+	session.Data.UserID = 42
+	is.NoErr(sessions.Save(ctx, session))
+	session, err = sessions.Load(ctx, session.ID)
+	is.NoErr(err)
+	is.Equal(session.Data.UserID, 42)
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t testing.TB) sesh.Store {
+		store, err := cryptstore.New(sesh.NewMemoryStore(), key1)
+		is.New(t).NoErr(err)
+		return store
+	})
+}
+
+func TestConflict(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	type Data struct {
+		Visits int
+	}
+	store, err := cryptstore.New(sesh.NewMemoryStore(), key1)
+	is.NoErr(err)
+	sessions := sesh.New[Data]()
+	sessions.Store = store
+	conflicts := 0
+	sessions.Conflict = func(latest, current *Data) (*Data, error) {
+		conflicts++
+		current.Visits = latest.Visits + 1
+		return current, nil
+	}
+	session, err := sessions.Load(ctx, "")
+	is.NoErr(err)
+	is.NoErr(sessions.Save(ctx, session))
+	first, err := sessions.Load(ctx, session.ID)
+	is.NoErr(err)
+	second, err := sessions.Load(ctx, session.ID)
+	is.NoErr(err)
+	first.Data.Visits++
+	is.NoErr(sessions.Save(ctx, first))
+	second.Data.Visits++
+	is.NoErr(sessions.Save(ctx, second))
+	is.Equal(conflicts, 1)
+	session, err = sessions.Load(ctx, session.ID)
+	is.NoErr(err)
+	is.Equal(session.Data.Visits, 2)
+}
+
+func TestUnsupported(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store, err := cryptstore.New(filestore.New(t.TempDir()), key1)
+	is.NoErr(err)
+	_, _, _, err = store.FindVersion(ctx, "session_token")
+	is.True(errors.Is(err, errors.ErrUnsupported))
+	err = store.UpsertIfVersion(ctx, "session_token", []byte("data"), time.Now().Add(time.Minute), 0)
+	is.True(errors.Is(err, errors.ErrUnsupported))
+	err = store.List(ctx, func(id string) error { return nil })
+	is.True(errors.Is(err, errors.ErrUnsupported))
+	// The manager falls back to unversioned writes
+	type Data struct {
+		UserID int
+	}
+	sessions := sesh.New[Data]()
+	sessions.Store = store
+	sessions.Conflict = func(latest, current *Data) (*Data, error) {
+		return current, nil
+	}
+	session, err := sessions.Load(ctx, "")
+	is.NoErr(err)
+	session.Data.UserID = 42
+	is.NoErr(sessions.Save(ctx, session))
+	session, err = sessions.Load(ctx, session.ID)
+	is.NoErr(err)
+	is.Equal(session.Data.UserID, 42)
+}
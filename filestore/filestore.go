@@ -0,0 +1,288 @@
+package filestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matthewmueller/sesh"
+)
+
+// New creates a store that keeps one file per session within dir. The
+// directory is created when the first session is written.
+func New(dir string) *Store {
+	return &Store{
+		dir: dir,
+		Now: time.Now,
+	}
+}
+
+// Store sessions on the filesystem. Session files are named after a hash of
+// the session id, so ids from cookies can't escape the directory, and are
+// spread across subdirectories by the first byte of the hash to keep
+// directories small.
+//
+// Each file holds the expiry followed by the session data:
+//
+//	expiry (unix nanoseconds, 8 bytes) | data
+//
+// Changes to a session file are serialized within the process, so Cleanup and
+// Touch can't act on a file that a concurrent Upsert has replaced. Cleanup also
+// checks that the expired file is still in place before removing it, which
+// narrows the race with other processes sharing the directory.
+type Store struct {
+	dir string
+
+	// Used for testing
+	Now func() time.Time
+
+	// locks serialize changes to session files, striped by file name
+	locks [256]sync.Mutex
+}
+
+var _ sesh.Store = (*Store)(nil)
+var _ sesh.Toucher = (*Store)(nil)
+
+const (
+	headerSize = 8
+	tempPrefix = ".tmp-"
+	// Temporary files older than this were left behind by an interrupted write
+	tempMaxAge = time.Hour
+)
+
+var errInvalidFile = errors.New("filestore: invalid session file")
+
+// path returns the file path for a session id
+func (s *Store) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+func (s *Store) Find(ctx context.Context, id string) (data []byte, expiry time.Time, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	file, err := os.ReadFile(s.path(id))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, time.Time{}, nil
+		}
+		return nil, time.Time{}, err
+	}
+	if len(file) < headerSize {
+		return nil, time.Time{}, errInvalidFile
+	}
+	expiry = decodeExpiry(file)
+	// Expired sessions are removed by Cleanup
+	if expiry.Before(s.Now()) {
+		return nil, time.Time{}, nil
+	}
+	return file[headerSize:], expiry, nil
+}
+
+// lock returns the mutex that guards the session file at path
+func (s *Store) lock(path string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(filepath.Base(path)))
+	return &s.locks[h.Sum32()%uint32(len(s.locks))]
+}
+
+// Upsert writes the session to a temporary file, then renames it over the
+// existing session, so readers never see a partially written session.
+func (s *Store) Upsert(ctx context.Context, id string, data []byte, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := s.path(id)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(encodeExpiry(expiry)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	mu := s.lock(path)
+	mu.Lock()
+	defer mu.Unlock()
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *Store) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := s.path(id)
+	mu := s.lock(path)
+	mu.Lock()
+	defer mu.Unlock()
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Touch updates the expiry in place without rewriting the session data.
+// Missing and expired sessions are left alone.
+func (s *Store) Touch(ctx context.Context, id string, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := s.path(id)
+	mu := s.lock(path)
+	mu.Lock()
+	defer mu.Unlock()
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return errInvalidFile
+	}
+	if decodeExpiry(header).Before(s.Now()) {
+		return nil
+	}
+	if _, err := file.WriteAt(encodeExpiry(expiry), 0); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Cleanup removes expired sessions from the store, along with any temporary
+// files left behind by interrupted writes. Other files in the directory are
+// left alone.
+func (s *Store) Cleanup(ctx context.Context) error {
+	now := s.Now()
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		// Leave anything the store didn't write alone
+		if entry.IsDir() {
+			if rel != "." && (len(parts) != 1 || !isHex(parts[0], 2)) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if len(parts) != 2 || !isHex(parts[0], 2) {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), tempPrefix) {
+			info, err := entry.Info()
+			if err != nil {
+				return ignoreNotExist(err)
+			}
+			if now.Sub(info.ModTime()) > tempMaxAge {
+				return ignoreNotExist(os.Remove(path))
+			}
+			return nil
+		}
+		if !isHex(parts[1], sha256.Size*2) || !strings.HasPrefix(parts[1], parts[0]) {
+			return nil
+		}
+		return ignoreNotExist(s.removeExpired(path, now))
+	})
+	// Nothing has been written yet
+	return ignoreNotExist(err)
+}
+
+// removeExpired removes the session file at path if it has expired, unless it
+// was replaced after its expiry was read
+func (s *Store) removeExpired(path string, now time.Time) error {
+	mu := s.lock(path)
+	mu.Lock()
+	defer mu.Unlock()
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header := make([]byte, headerSize)
+	// Session files too short to hold an expiry are removed too
+	if _, err := io.ReadFull(file, header); err == nil && !decodeExpiry(header).Before(now) {
+		return nil
+	}
+	opened, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	current, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// Another process replaced the file
+	if !os.SameFile(opened, current) {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// isHex returns true if name is n lowercase hex characters, like the names of
+// session files and their directories
+func isHex(name string, n int) bool {
+	if len(name) != n {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func ignoreNotExist(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func encodeExpiry(expiry time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(expiry.UnixNano()))
+}
+
+func decodeExpiry(header []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(header)))
+}
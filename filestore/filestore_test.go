@@ -0,0 +1,216 @@
+package filestore_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/filestore"
+	"github.com/matthewmueller/sesh/storetest"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t testing.TB) sesh.Store {
+		return filestore.New(t.TempDir())
+	})
+}
+
+// files returns the paths of every file within dir
+func files(t testing.TB, dir string) (paths []string) {
+	t.Helper()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestPathTraversal(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	root := t.TempDir()
+	dir := filepath.Join(root, "sessions")
+	store := filestore.New(dir)
+	ids := []string{"../escape", "../../etc/passwd", "/abs", "a/b", `..\win`, "", "\x00"}
+	for _, id := range ids {
+		err := store.Upsert(ctx, id, []byte(id), time.Now().Add(time.Minute))
+		is.NoErr(err)
+		data, _, err := store.Find(ctx, id)
+		is.NoErr(err)
+		is.Equal(string(data), id)
+	}
+	// Everything was written within the sessions directory
+	entries, err := os.ReadDir(root)
+	is.NoErr(err)
+	is.Equal(len(entries), 1)
+	is.Equal(entries[0].Name(), "sessions")
+	// Files are sharded by the first byte of their hashed name
+	paths := files(t, dir)
+	is.Equal(len(paths), len(ids))
+	for _, path := range paths {
+		shard, name, ok := strings.Cut(path, "/")
+		is.True(ok)
+		is.Equal(len(name), 64)
+		is.Equal(shard, name[:2])
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	dir := t.TempDir()
+	store := filestore.New(dir)
+	// Cleaning up an empty store
+	is.NoErr(store.Cleanup(ctx))
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.Now = func() time.Time { return now }
+	is.NoErr(store.Upsert(ctx, "expired", []byte("1"), now.Add(-time.Minute)))
+	is.NoErr(store.Upsert(ctx, "active", []byte("2"), now.Add(time.Minute)))
+	is.Equal(len(files(t, dir)), 2)
+	is.NoErr(store.Cleanup(ctx))
+	is.Equal(len(files(t, dir)), 1)
+	data, _, err := store.Find(ctx, "active")
+	is.NoErr(err)
+	is.Equal(string(data), "2")
+}
+
+func TestCleanupConcurrent(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := filestore.New(t.TempDir())
+	for i := 0; i < 100; i++ {
+		is.NoErr(store.Upsert(ctx, "session_token", []byte("old"), time.Now().Add(-time.Minute)))
+		// Cleanup must not remove the session that replaced the expired one
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			is.NoErr(store.Upsert(ctx, "session_token", []byte("new"), time.Now().Add(time.Minute)))
+		}()
+		go func() {
+			defer wg.Done()
+			is.NoErr(store.Cleanup(ctx))
+		}()
+		wg.Wait()
+		data, _, err := store.Find(ctx, "session_token")
+		is.NoErr(err)
+		is.Equal(string(data), "new")
+	}
+}
+
+func TestTouchConcurrent(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := filestore.New(t.TempDir())
+	expiry := time.Now().Add(time.Hour)
+	for i := 0; i < 100; i++ {
+		is.NoErr(store.Upsert(ctx, "session_token", []byte("old"), time.Now().Add(time.Minute)))
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			is.NoErr(store.Upsert(ctx, "session_token", []byte("new"), expiry))
+		}()
+		go func() {
+			defer wg.Done()
+			is.NoErr(store.Touch(ctx, "session_token", expiry))
+		}()
+		wg.Wait()
+		// Whichever runs last, the session ends up with the new data and expiry
+		data, actual, err := store.Find(ctx, "session_token")
+		is.NoErr(err)
+		is.Equal(string(data), "new")
+		is.Equal(actual.UnixNano(), expiry.UnixNano())
+	}
+}
+
+func TestCleanupTemp(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	dir := t.TempDir()
+	store := filestore.New(dir)
+	// Simulate a write that was interrupted before the rename
+	is.NoErr(os.MkdirAll(filepath.Join(dir, "ab"), 0700))
+	tmp := filepath.Join(dir, "ab", ".tmp-123")
+	is.NoErr(os.WriteFile(tmp, []byte("partial"), 0600))
+	// Recent temporary files may still be in use
+	is.NoErr(store.Cleanup(ctx))
+	is.Equal(len(files(t, dir)), 1)
+	store.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	is.NoErr(store.Cleanup(ctx))
+	is.Equal(len(files(t, dir)), 0)
+}
+
+func TestCleanupOtherFiles(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	dir := t.TempDir()
+	store := filestore.New(dir)
+	store.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	// Files that weren't written by the store, some short and some with a
+	// header that looks like an expiry in the past
+	others := []string{
+		filepath.Join(dir, "notes.txt"),
+		filepath.Join(dir, "logo.png"),
+		filepath.Join(dir, ".tmp-123"),
+		filepath.Join(dir, "ab", "notes.txt"),
+		filepath.Join(dir, "ab", strings.Repeat("cd", 32)),
+		filepath.Join(dir, "images", ".tmp-123"),
+		filepath.Join(dir, "images", strings.Repeat("ab", 32)),
+	}
+	for i, path := range others {
+		is.NoErr(os.MkdirAll(filepath.Dir(path), 0700))
+		data := []byte("hi")
+		if i%2 == 1 {
+			data = []byte("\x89PNG\r\n\x1a\n...")
+		}
+		is.NoErr(os.WriteFile(path, data, 0600))
+		is.NoErr(os.Chtimes(path, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)))
+	}
+	is.NoErr(store.Upsert(ctx, "expired", []byte("1"), time.Now()))
+	is.NoErr(store.Cleanup(ctx))
+	is.Equal(len(files(t, dir)), len(others))
+	for _, path := range others {
+		_, err := os.Stat(path)
+		is.NoErr(err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	type Data struct {
+		UserID int
+	}
+	dir := t.TempDir()
+	sessions := sesh.New[Data]()
+	sessions.Store = filestore.New(dir)
+	session, err := sessions.Load(ctx, "")
+	is.NoErr(err)
+	session.Data.UserID = 42
+	is.NoErr(sessions.Save(ctx, session))
+	// Sessions survive a restart
+	sessions = sesh.New[Data]()
+	sessions.Store = filestore.New(dir)
+	session, err = sessions.Load(ctx, session.ID)
+	is.NoErr(err)
+	is.Equal(session.Data.UserID, 42)
+}
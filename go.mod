@@ -3,22 +3,26 @@ module github.com/matthewmueller/sesh
 go 1.23.0
 
 require (
+	github.com/felixge/httpsnoop v1.0.3
 	github.com/matryer/is v1.4.1
 	github.com/matthewmueller/diff v0.0.3
 	github.com/matthewmueller/httpbuf v0.0.2
 	github.com/mattn/go-sqlite3 v1.14.23
+	github.com/redis/go-redis/v9 v9.7.0
+	go.etcd.io/bbolt v1.3.11
 	golang.org/x/sync v0.8.0
 )
 
 require (
-	github.com/felixge/httpsnoop v1.0.3 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/google/go-cmp v0.5.6 // indirect
 	github.com/hexops/valast v1.4.1 // indirect
 	github.com/lithammer/dedent v1.1.0 // indirect
 	github.com/sergi/go-diff v1.0.0 // indirect
 	github.com/shurcooL/go-goon v0.0.0-20170922171312-37c2f522c041 // indirect
 	golang.org/x/mod v0.5.1 // indirect
-	golang.org/x/sys v0.0.0-20211117180635-dee7805ff2e1 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 	golang.org/x/tools v0.1.8-0.20211102182255-bb4add04ddef // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	mvdan.cc/gofumpt v0.2.0 // indirect
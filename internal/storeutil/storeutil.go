@@ -0,0 +1,66 @@
+// Package storeutil contains helpers shared by the session stores.
+package storeutil
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the part of sesh.Store that Touch needs
+type Store interface {
+	Find(ctx context.Context, id string) (data []byte, expiry time.Time, err error)
+	Upsert(ctx context.Context, id string, data []byte, expiry time.Time) (err error)
+}
+
+// Toucher is sesh.Toucher
+type Toucher interface {
+	Touch(ctx context.Context, id string, expiry time.Time) (err error)
+}
+
+// Touch updates the expiry of a session in any store. Stores that implement
+// Toucher are touched, otherwise the session is rewritten with the new expiry.
+// Missing sessions are left alone.
+func Touch(ctx context.Context, store Store, id string, expiry time.Time) error {
+	if toucher, ok := store.(Toucher); ok {
+		return toucher.Touch(ctx, id, expiry)
+	}
+	data, _, err := store.Find(ctx, id)
+	if err != nil || data == nil {
+		return err
+	}
+	return store.Upsert(ctx, id, data, expiry)
+}
+
+// StartCleanup calls cleanup every interval in a background goroutine until the
+// context is cancelled. Stores use it to remove expired sessions. After each
+// cleanup, report is called with the number of sessions removed and any error.
+// Report may be nil. The returned channel is closed once the goroutine has
+// stopped. An interval that isn't positive doesn't start the goroutine.
+func StartCleanup(ctx context.Context, interval time.Duration, cleanup func(ctx context.Context) (removed int64, err error), report func(removed int64, err error)) <-chan struct{} {
+	done := make(chan struct{})
+	if interval <= 0 {
+		close(done)
+		return done
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				removed, err := cleanup(ctx)
+				// Don't report errors caused by stopping
+				if ctx.Err() != nil {
+					return
+				}
+				if report != nil {
+					report(removed, err)
+				}
+			}
+		}
+	}()
+	return done
+}
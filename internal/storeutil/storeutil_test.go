@@ -0,0 +1,65 @@
+package storeutil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/sesh/internal/storeutil"
+	"github.com/matthewmueller/sesh/mockstore"
+)
+
+func TestTouch(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := mockstore.New()
+	stored := map[string]time.Time{}
+	store.MockFind = func(ctx context.Context, id string) ([]byte, time.Time, error) {
+		if id == "missing" {
+			return nil, time.Time{}, nil
+		}
+		return []byte("encoded_data"), time.Now().Add(time.Minute), nil
+	}
+	store.MockUpsert = func(ctx context.Context, id string, data []byte, expiry time.Time) error {
+		is.Equal(string(data), "encoded_data")
+		stored[id] = expiry
+		return nil
+	}
+	expiry := time.Now().Add(time.Hour)
+	is.NoErr(storeutil.Touch(ctx, store, "session_token", expiry))
+	is.True(stored["session_token"].Equal(expiry))
+	// Missing sessions aren't created
+	is.NoErr(storeutil.Touch(ctx, store, "missing", expiry))
+	is.Equal(len(stored), 1)
+}
+
+func TestStartCleanup(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reports := make(chan int64)
+	done := storeutil.StartCleanup(ctx, time.Millisecond, func(ctx context.Context) (int64, error) {
+		return 3, nil
+	}, func(removed int64, err error) {
+		is.NoErr(err)
+		select {
+		case reports <- removed:
+		case <-ctx.Done():
+		}
+	})
+	is.Equal(<-reports, int64(3))
+	cancel()
+	<-done
+}
+
+func TestStartCleanupInterval(t *testing.T) {
+	ctx := context.Background()
+	for _, interval := range []time.Duration{0, -time.Second} {
+		done := storeutil.StartCleanup(ctx, interval, func(ctx context.Context) (int64, error) {
+			t.Error("cleanup shouldn't run")
+			return 0, nil
+		}, nil)
+		<-done
+	}
+}
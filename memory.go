@@ -1,51 +1,256 @@
 package sesh
 
 import (
+	"container/list"
 	"context"
 	"sync"
 	"time"
+
+	"github.com/matthewmueller/sesh/internal/storeutil"
 )
 
-func newMemoryStore() *memoryStore {
-	return &memoryStore{
-		sync.Mutex{},
-		map[string]memorySession{},
+// NewMemoryStore creates an in-memory session store. Sessions last until your
+// server restarts. Expired sessions are removed when they're found. Call
+// StartJanitor to also remove them in the background.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		Now:      time.Now,
+		sessions: map[string]*list.Element{},
+		lru:      list.New(),
 	}
 }
 
-// memoryStore is the default session store
-type memoryStore struct {
+// MemoryStore is the default session store
+type MemoryStore struct {
+	// MaxEntries is the maximum number of sessions to keep in memory. When
+	// exceeded, the least recently used session is evicted. The default value of
+	// 0 means there is no limit.
+	MaxEntries int
+
+	// Now is used to get the current time. This is useful for testing.
+	Now func() time.Time
+
 	mu       sync.Mutex
-	sessions map[string]memorySession
+	sessions map[string]*list.Element
+	lru      *list.List // Most recently used at the front
+	stop     context.CancelFunc
+	done     <-chan struct{}
 }
 
-var _ Store = (*memoryStore)(nil)
+var _ Store = (*MemoryStore)(nil)
+var _ Toucher = (*MemoryStore)(nil)
+var _ VersionedStore = (*MemoryStore)(nil)
+var _ Lister = (*MemoryStore)(nil)
 
 type memorySession struct {
-	data   []byte
-	expiry time.Time
+	id      string
+	data    []byte
+	expiry  time.Time
+	version int64
+}
+
+// find the session, removing it if it's expired. Must be called with the lock.
+func (s *MemoryStore) find(id string) (*memorySession, bool) {
+	el, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	session := el.Value.(*memorySession)
+	if session.expiry.Before(s.Now()) {
+		s.remove(el)
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	return session, true
+}
+
+// set the session, evicting the least recently used sessions if there are too
+// many. Must be called with the lock.
+func (s *MemoryStore) set(session *memorySession) {
+	if el, ok := s.sessions[session.id]; ok {
+		el.Value = session
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.sessions[session.id] = s.lru.PushFront(session)
+	for s.MaxEntries > 0 && s.lru.Len() > s.MaxEntries {
+		s.remove(s.lru.Back())
+	}
+}
+
+// remove the session. Must be called with the lock.
+func (s *MemoryStore) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.sessions, el.Value.(*memorySession).id)
 }
 
-func (s *memoryStore) Delete(_ context.Context, id string) error {
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.sessions, id)
+	if el, ok := s.sessions[id]; ok {
+		s.remove(el)
+	}
 	return nil
 }
 
-func (s *memoryStore) Find(_ context.Context, id string) (data []byte, expiry time.Time, err error) {
+func (s *MemoryStore) Find(ctx context.Context, id string) (data []byte, expiry time.Time, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, expiry, err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	session, ok := s.sessions[id]
+	session, ok := s.find(id)
 	if !ok {
 		return nil, expiry, nil
 	}
 	return session.data, session.expiry, nil
 }
 
-func (s *memoryStore) Upsert(_ context.Context, id string, data []byte, expiry time.Time) error {
+func (s *MemoryStore) Upsert(ctx context.Context, id string, data []byte, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var version int64
+	if session, ok := s.sessions[id]; ok {
+		version = session.Value.(*memorySession).version
+	}
+	s.set(&memorySession{id, data, expiry, version + 1})
+	return nil
+}
+
+func (s *MemoryStore) Touch(ctx context.Context, id string, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.find(id)
+	if !ok {
+		return nil
+	}
+	s.set(&memorySession{id, session.data, expiry, session.version})
+	return nil
+}
+
+func (s *MemoryStore) FindVersion(ctx context.Context, id string) (data []byte, expiry time.Time, version int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, expiry, 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.find(id)
+	if !ok {
+		return nil, expiry, 0, nil
+	}
+	return session.data, session.expiry, session.version, nil
+}
+
+func (s *MemoryStore) UpsertIfVersion(ctx context.Context, id string, data []byte, expiry time.Time, version int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var current int64
+	if session, ok := s.find(id); ok {
+		current = session.version
+	}
+	if current != version {
+		return ErrConflict
+	}
+	s.set(&memorySession{id, data, expiry, version + 1})
+	return nil
+}
+
+// Cleanup removes expired sessions from the store.
+func (s *MemoryStore) Cleanup(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.sessions[id] = memorySession{data, expiry}
+	now := s.Now()
+	for _, el := range s.sessions {
+		if el.Value.(*memorySession).expiry.Before(now) {
+			s.remove(el)
+		}
+	}
 	return nil
 }
+
+// List calls fn with the id of every session that hasn't expired. Fn is called
+// without holding the lock, so it can use the store.
+func (s *MemoryStore) List(ctx context.Context, fn func(id string) error) error {
+	s.mu.Lock()
+	now := s.Now()
+	ids := make([]string, 0, len(s.sessions))
+	for id, el := range s.sessions {
+		if !el.Value.(*memorySession).expiry.Before(now) {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of sessions in the store, including expired sessions
+// that haven't been removed yet.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// StartJanitor starts a background goroutine that removes expired sessions
+// every interval, stopping the janitor that was running before. Call Close to
+// stop the janitor. An interval that isn't positive stops any running janitor
+// without starting a new one.
+func (s *MemoryStore) StartJanitor(interval time.Duration) {
+	s.mu.Lock()
+	// Replace the janitor in one step, so concurrent calls can't leave a janitor
+	// running that Close doesn't know about
+	prevStop, prevDone := s.stop, s.done
+	s.stop, s.done = nil, nil
+	if interval > 0 {
+		ctx, stop := context.WithCancel(context.Background())
+		s.stop = stop
+		s.done = storeutil.StartCleanup(ctx, interval, func(ctx context.Context) (int64, error) {
+			return 0, s.Cleanup(ctx)
+		}, nil)
+	}
+	s.mu.Unlock()
+	stopJanitor(prevStop, prevDone)
+}
+
+// Close stops the janitor, if it's running. The store can still be used after
+// it's closed.
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mu.Unlock()
+	stopJanitor(stop, done)
+	return nil
+}
+
+// stopJanitor stops the janitor and waits for it to finish
+func stopJanitor(stop context.CancelFunc, done <-chan struct{}) {
+	if stop == nil {
+		return
+	}
+	stop()
+	<-done
+}
@@ -0,0 +1,185 @@
+package sesh_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/storetest"
+)
+
+func TestMemoryUpsertFind(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := sesh.NewMemoryStore()
+	inputData := []byte("encoded_data")
+	inputExpiry := time.Now().Add(time.Minute)
+	err := store.Upsert(ctx, "session_token", inputData, inputExpiry)
+	is.NoErr(err)
+	actualData, actualExpiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(actualData), string(inputData))
+	is.True(actualExpiry.Equal(inputExpiry))
+	err = store.Delete(ctx, "session_token")
+	is.NoErr(err)
+	data, expiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.True(expiry.IsZero())
+}
+
+func TestMemoryExpired(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := sesh.NewMemoryStore()
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(-time.Minute))
+	is.NoErr(err)
+	is.Equal(store.Len(), 1)
+	data, expiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.True(expiry.IsZero())
+	// Expired sessions are removed when they're found
+	is.Equal(store.Len(), 0)
+}
+
+func TestMemoryCleanup(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := sesh.NewMemoryStore()
+	err := store.Upsert(ctx, "s1", []byte("1"), time.Now().Add(-time.Minute))
+	is.NoErr(err)
+	err = store.Upsert(ctx, "s2", []byte("2"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	is.NoErr(store.Cleanup(ctx))
+	is.Equal(store.Len(), 1)
+	data, _, err := store.Find(ctx, "s2")
+	is.NoErr(err)
+	is.Equal(string(data), "2")
+}
+
+func TestMemoryMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := sesh.NewMemoryStore()
+	store.MaxEntries = 2
+	expiry := time.Now().Add(time.Minute)
+	is.NoErr(store.Upsert(ctx, "s1", []byte("1"), expiry))
+	is.NoErr(store.Upsert(ctx, "s2", []byte("2"), expiry))
+	// Use s1 so s2 is the least recently used
+	data, _, err := store.Find(ctx, "s1")
+	is.NoErr(err)
+	is.Equal(string(data), "1")
+	is.NoErr(store.Upsert(ctx, "s3", []byte("3"), expiry))
+	is.Equal(store.Len(), 2)
+	data, _, err = store.Find(ctx, "s2")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	data, _, err = store.Find(ctx, "s1")
+	is.NoErr(err)
+	is.Equal(string(data), "1")
+	data, _, err = store.Find(ctx, "s3")
+	is.NoErr(err)
+	is.Equal(string(data), "3")
+}
+
+func TestMemoryJanitor(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := sesh.NewMemoryStore()
+	store.StartJanitor(time.Millisecond)
+	defer store.Close()
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(-time.Minute))
+	is.NoErr(err)
+	for store.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	is.NoErr(store.Close())
+	// Closing twice is a no-op
+	is.NoErr(store.Close())
+	// The store is still usable after closing
+	err = store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(-time.Minute))
+	is.NoErr(err)
+	time.Sleep(5 * time.Millisecond)
+	is.Equal(store.Len(), 1)
+}
+
+func TestMemoryJanitorInterval(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := sesh.NewMemoryStore()
+	store.StartJanitor(time.Millisecond)
+	// Doesn't panic and stops the running janitor
+	store.StartJanitor(0)
+	store.StartJanitor(-time.Second)
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(-time.Minute))
+	is.NoErr(err)
+	time.Sleep(5 * time.Millisecond)
+	is.Equal(store.Len(), 1)
+	is.NoErr(store.Close())
+}
+
+func TestMemoryJanitorConcurrent(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := sesh.NewMemoryStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.StartJanitor(time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	is.NoErr(store.Close())
+	// None of the janitors are left running
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(-time.Minute))
+	is.NoErr(err)
+	time.Sleep(5 * time.Millisecond)
+	is.Equal(store.Len(), 1)
+}
+
+func TestMemoryTouch(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := sesh.NewMemoryStore()
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	newExpiry := time.Now().Add(time.Hour)
+	is.NoErr(store.Touch(ctx, "session_token", newExpiry))
+	data, expiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	is.True(expiry.Equal(newExpiry))
+	// Touching a missing session is a no-op
+	is.NoErr(store.Touch(ctx, "missing", newExpiry))
+	is.Equal(store.Len(), 1)
+}
+
+func TestMemoryUpsertIfVersion(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := sesh.NewMemoryStore()
+	expiry := time.Now().Add(time.Minute)
+	is.NoErr(store.UpsertIfVersion(ctx, "session_token", []byte("v1"), expiry, 0))
+	err := store.UpsertIfVersion(ctx, "session_token", []byte("v1"), expiry, 0)
+	is.True(errors.Is(err, sesh.ErrConflict))
+	is.NoErr(store.UpsertIfVersion(ctx, "session_token", []byte("v2"), expiry, 1))
+	err = store.UpsertIfVersion(ctx, "session_token", []byte("v3"), expiry, 1)
+	is.True(errors.Is(err, sesh.ErrConflict))
+	data, _, version, err := store.FindVersion(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "v2")
+	is.Equal(version, int64(2))
+}
+
+func TestMemoryStoreContract(t *testing.T) {
+	storetest.Run(t, func(t testing.TB) sesh.Store {
+		return sesh.NewMemoryStore()
+	})
+}
@@ -0,0 +1,23 @@
+package sesh
+
+import "fmt"
+
+// Migration upgrades session data encoded by the codec from one schema version
+// to the next. Typically a migration decodes the data into the previous
+// version of the session data, converts it and encodes it again.
+type Migration func(data []byte) ([]byte, error)
+
+// migrate the session data from the given schema version to the current one
+func (m *Manager[Data]) migrate(schema uint64, data []byte) (_ []byte, err error) {
+	current := uint64(len(m.Migrations))
+	if schema > current {
+		return nil, fmt.Errorf("sesh: session schema version %d is newer than %d", schema, current)
+	}
+	for ; schema < current; schema++ {
+		data, err = m.Migrations[schema](data)
+		if err != nil {
+			return nil, fmt.Errorf("sesh: unable to migrate session from schema version %d: %w", schema, err)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,231 @@
+package migratestore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/internal/storeutil"
+)
+
+// New creates a store that moves sessions from the old store to the new store
+// without logging anyone out. Once every session has been copied, or every
+// session in the old store has expired, replace it with the new store.
+func New(old, new sesh.Store) *Store {
+	return &Store{old: old, new: new}
+}
+
+// Store reads sessions from the new store, falling back to the old store and
+// copying sessions it finds there to the new store. Sessions are only written
+// to the new store. The old store is left as it was, apart from deletes, so you
+// can switch back to it.
+type Store struct {
+	// DeleteOld removes sessions from the old store once they've been copied to
+	// the new store. Without it, a session that expires in the new store before
+	// it does in the old store can be read from the old store again.
+	DeleteOld bool
+
+	old sesh.Store
+	new sesh.Store
+}
+
+var _ sesh.Store = (*Store)(nil)
+var _ sesh.Toucher = (*Store)(nil)
+var _ sesh.VersionedStore = (*Store)(nil)
+var _ sesh.Lister = (*Store)(nil)
+
+var errUnlisted = errors.New("migratestore: old store doesn't implement sesh.Lister")
+
+// Find the session in the new store, falling back to the old store
+func (s *Store) Find(ctx context.Context, id string) (data []byte, expiry time.Time, err error) {
+	data, expiry, err = s.new.Find(ctx, id)
+	if err != nil || data != nil {
+		return data, expiry, err
+	}
+	data, expiry, err = s.old.Find(ctx, id)
+	if err != nil || data == nil {
+		return data, expiry, err
+	}
+	copied, err := s.copy(ctx, id, data, expiry)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if copied {
+		return data, expiry, nil
+	}
+	// The session was written to the new store while copying
+	return s.new.Find(ctx, id)
+}
+
+// copy the session to the new store, unless it's already there, removing it
+// from the old store if DeleteOld is set. Returns false if the session was
+// already in the new store or was deleted while copying.
+func (s *Store) copy(ctx context.Context, id string, data []byte, expiry time.Time) (copied bool, err error) {
+	copied, err = s.insert(ctx, id, data, expiry)
+	if err != nil {
+		return false, err
+	}
+	if copied {
+		// A concurrent Delete may have removed the session after it was read
+		// from the old store, so undo the copy rather than bring it back
+		existing, _, err := s.old.Find(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		if existing == nil {
+			return false, s.new.Delete(ctx, id)
+		}
+	}
+	if s.DeleteOld {
+		if err := s.old.Delete(ctx, id); err != nil {
+			return false, err
+		}
+	}
+	return copied, nil
+}
+
+// insert the session into the new store, unless it's already there
+func (s *Store) insert(ctx context.Context, id string, data []byte, expiry time.Time) (inserted bool, err error) {
+	// Versioned stores can insert the session without overwriting a newer write
+	if versioned, ok := s.new.(sesh.VersionedStore); ok {
+		err := versioned.UpsertIfVersion(ctx, id, data, expiry, 0)
+		if err == nil {
+			return true, nil
+		} else if errors.Is(err, sesh.ErrConflict) {
+			return false, nil
+		} else if !errors.Is(err, errors.ErrUnsupported) {
+			return false, err
+		}
+	}
+	existing, _, err := s.new.Find(ctx, id)
+	if err != nil {
+		return false, err
+	} else if existing != nil {
+		return false, nil
+	}
+	if err := s.new.Upsert(ctx, id, data, expiry); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Upsert writes the session to the new store
+func (s *Store) Upsert(ctx context.Context, id string, data []byte, expiry time.Time) error {
+	return s.new.Upsert(ctx, id, data, expiry)
+}
+
+// FindVersion is like Find, but also returns the version of the session in the
+// new store. Sessions found in the old store are copied to the new store first.
+// It returns errors.ErrUnsupported if the new store isn't versioned.
+func (s *Store) FindVersion(ctx context.Context, id string) (data []byte, expiry time.Time, version int64, err error) {
+	versioned, ok := s.new.(sesh.VersionedStore)
+	if !ok {
+		return nil, time.Time{}, 0, errors.ErrUnsupported
+	}
+	data, expiry, version, err = versioned.FindVersion(ctx, id)
+	if err != nil || data != nil {
+		return data, expiry, version, err
+	}
+	data, expiry, err = s.old.Find(ctx, id)
+	if err != nil || data == nil {
+		return nil, time.Time{}, 0, err
+	}
+	if _, err := s.copy(ctx, id, data, expiry); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	return versioned.FindVersion(ctx, id)
+}
+
+// UpsertIfVersion is like Upsert, but returns sesh.ErrConflict if the session
+// in the new store has been changed since version. It returns
+// errors.ErrUnsupported if the new store isn't versioned.
+func (s *Store) UpsertIfVersion(ctx context.Context, id string, data []byte, expiry time.Time, version int64) error {
+	versioned, ok := s.new.(sesh.VersionedStore)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return versioned.UpsertIfVersion(ctx, id, data, expiry, version)
+}
+
+// Delete the session from both stores. The old store goes first, so a
+// concurrent Find that copies the session afterwards sees that it's gone from
+// the old store and removes its copy from the new store.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	if err := s.old.Delete(ctx, id); err != nil {
+		return err
+	}
+	return s.new.Delete(ctx, id)
+}
+
+// Touch updates the expiry of the session in the new store, copying it from
+// the old store first if needed
+func (s *Store) Touch(ctx context.Context, id string, expiry time.Time) error {
+	if _, _, err := s.Find(ctx, id); err != nil {
+		return err
+	}
+	return storeutil.Touch(ctx, s.new, id, expiry)
+}
+
+// Copy every session from the old store to the new store, returning the
+// number of sessions copied. Sessions already in the new store aren't
+// overwritten. Either way, the session is removed from the old store when
+// DeleteOld is set. The old store must implement sesh.Lister.
+func (s *Store) Copy(ctx context.Context) (copied int64, err error) {
+	lister, ok := s.old.(sesh.Lister)
+	if !ok {
+		return 0, errUnlisted
+	}
+	err = lister.List(ctx, func(id string) error {
+		data, expiry, err := s.old.Find(ctx, id)
+		if err != nil || data == nil {
+			return err
+		}
+		ok, err := s.copy(ctx, id, data, expiry)
+		if err != nil {
+			return err
+		}
+		if ok {
+			copied++
+		}
+		return nil
+	})
+	if errors.Is(err, errors.ErrUnsupported) {
+		return copied, errUnlisted
+	}
+	return copied, err
+}
+
+// List the sessions in the new store, then the sessions in the old store. A
+// session that's moved while listing may be listed twice. It returns
+// errors.ErrUnsupported if either store doesn't implement sesh.Lister.
+func (s *Store) List(ctx context.Context, fn func(id string) error) error {
+	newLister, ok := s.new.(sesh.Lister)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	oldLister, ok := s.old.(sesh.Lister)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	if err := newLister.List(ctx, fn); err != nil {
+		return err
+	}
+	return oldLister.List(ctx, fn)
+}
+
+// StartCopy copies every session from the old store to the new store in a
+// background goroutine. Once it's done, report is called with the number of
+// sessions copied and any error. Report may be nil. The returned channel is
+// closed once the goroutine has stopped.
+func (s *Store) StartCopy(ctx context.Context, report func(copied int64, err error)) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		copied, err := s.Copy(ctx)
+		if report != nil {
+			report(copied, err)
+		}
+	}()
+	return done
+}
@@ -0,0 +1,244 @@
+package migratestore_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/cryptstore"
+	"github.com/matthewmueller/sesh/filestore"
+	"github.com/matthewmueller/sesh/migratestore"
+	"github.com/matthewmueller/sesh/mockstore"
+	"github.com/matthewmueller/sesh/storetest"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t testing.TB) sesh.Store {
+		return migratestore.New(sesh.NewMemoryStore(), sesh.NewMemoryStore())
+	})
+}
+
+func TestFallback(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	old, new := sesh.NewMemoryStore(), sesh.NewMemoryStore()
+	store := migratestore.New(old, new)
+	inputExpiry := time.Now().Add(time.Minute)
+	err := old.Upsert(ctx, "session_token", []byte("encoded_data"), inputExpiry)
+	is.NoErr(err)
+	// The session is moved to the new store when it's read
+	data, expiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	is.Equal(expiry.Unix(), inputExpiry.Unix())
+	data, expiry, err = new.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	is.Equal(expiry.Unix(), inputExpiry.Unix())
+	// Writes only go to the new store, so the old store can still be used
+	err = store.Upsert(ctx, "session_token", []byte("new_encoded_data"), inputExpiry)
+	is.NoErr(err)
+	data, _, err = store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "new_encoded_data")
+	data, _, err = old.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	// Deletes remove the session from both stores
+	is.NoErr(store.Delete(ctx, "session_token"))
+	is.Equal(old.Len(), 0)
+	is.Equal(new.Len(), 0)
+}
+
+func TestDeleteOld(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	old, new := sesh.NewMemoryStore(), sesh.NewMemoryStore()
+	store := migratestore.New(old, new)
+	store.DeleteOld = true
+	err := old.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	// The session is moved to the new store when it's read
+	data, _, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	is.Equal(old.Len(), 0)
+	is.Equal(new.Len(), 1)
+}
+
+func TestDeleteWhileCopying(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	memory, new := sesh.NewMemoryStore(), sesh.NewMemoryStore()
+	err := memory.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	old := mockstore.New()
+	old.MockDelete = memory.Delete
+	var store *migratestore.Store
+	old.MockFind = func(ctx context.Context, id string) ([]byte, time.Time, error) {
+		data, expiry, err := memory.Find(ctx, id)
+		if err != nil || data == nil {
+			return data, expiry, err
+		}
+		// The session is deleted after it's been read from the old store, but
+		// before it's been copied to the new store
+		old.MockFind = memory.Find
+		if err := store.Delete(ctx, id); err != nil {
+			return nil, time.Time{}, err
+		}
+		return data, expiry, nil
+	}
+	store = migratestore.New(old, new)
+	data, _, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.Equal(new.Len(), 0)
+	data, _, err = store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+}
+
+func TestCopyKeepsNewer(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	old, new := sesh.NewMemoryStore(), sesh.NewMemoryStore()
+	store := migratestore.New(old, new)
+	store.DeleteOld = true
+	err := old.Upsert(ctx, "session_token", []byte("old_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	err = new.Upsert(ctx, "session_token", []byte("new_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	copied, err := store.Copy(ctx)
+	is.NoErr(err)
+	is.Equal(copied, int64(0))
+	data, _, err := new.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "new_data")
+	// The stale session is removed from the old store
+	is.Equal(old.Len(), 0)
+}
+
+func TestExpiredAfterMove(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	old, new := sesh.NewMemoryStore(), sesh.NewMemoryStore()
+	now := time.Now()
+	old.Now = func() time.Time { return now }
+	new.Now = func() time.Time { return now }
+	store := migratestore.New(old, new)
+	store.DeleteOld = true
+	err := old.Upsert(ctx, "session_token", []byte("old_data"), now.Add(time.Hour))
+	is.NoErr(err)
+	data, _, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "old_data")
+	// The session is written again with a shorter expiry
+	err = store.Upsert(ctx, "session_token", []byte("new_data"), now.Add(time.Minute))
+	is.NoErr(err)
+	// Once it expires, the stale session isn't read from the old store
+	now = now.Add(2 * time.Minute)
+	data, _, err = store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+}
+
+func TestStartCopy(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	old, new := sesh.NewMemoryStore(), sesh.NewMemoryStore()
+	store := migratestore.New(old, new)
+	for i := 0; i < 10; i++ {
+		err := old.Upsert(ctx, "s"+strconv.Itoa(i), []byte("data"), time.Now().Add(time.Minute))
+		is.NoErr(err)
+	}
+	err := old.Upsert(ctx, "expired", []byte("data"), time.Now().Add(-time.Minute))
+	is.NoErr(err)
+	reports := make(chan int64, 1)
+	done := store.StartCopy(ctx, func(copied int64, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		reports <- copied
+	})
+	<-done
+	is.Equal(<-reports, int64(10))
+	is.Equal(new.Len(), 10)
+	// Copying again is a no-op
+	copied, err := store.Copy(ctx)
+	is.NoErr(err)
+	is.Equal(copied, int64(0))
+}
+
+func TestCopyUnlisted(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := migratestore.New(mockstore.New(), sesh.NewMemoryStore())
+	_, err := store.Copy(ctx)
+	is.Equal(err.Error(), "migratestore: old store doesn't implement sesh.Lister")
+}
+
+func TestSession(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	type Data struct {
+		UserID int
+	}
+	old := sesh.NewMemoryStore()
+	sessions := sesh.New[Data]()
+	sessions.Store = old
+	session, err := sessions.Load(ctx, "")
+	is.NoErr(err)
+	session.Data.UserID = 42
+	is.NoErr(sessions.Save(ctx, session))
+	// Switch to the new store without logging anyone out
+	sessions.Store = migratestore.New(old, sesh.NewMemoryStore())
+	session, err = sessions.Load(ctx, session.ID)
+	is.NoErr(err)
+	is.Equal(session.Data.UserID, 42)
+}
+
+func TestFindVersion(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	old, new := sesh.NewMemoryStore(), sesh.NewMemoryStore()
+	store := migratestore.New(old, new)
+	err := old.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	// The session is copied, so the version comes from the new store
+	data, _, version, err := store.FindVersion(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	is.Equal(version, int64(1))
+	err = store.UpsertIfVersion(ctx, "session_token", []byte("new_encoded_data"), time.Now().Add(time.Minute), 0)
+	is.True(errors.Is(err, sesh.ErrConflict))
+	err = store.UpsertIfVersion(ctx, "session_token", []byte("new_encoded_data"), time.Now().Add(time.Minute), version)
+	is.NoErr(err)
+}
+
+func TestCopyWrapped(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	key := bytes.Repeat([]byte("k"), 32)
+	// Wrapped stores forward sesh.Lister
+	old, err := cryptstore.New(sesh.NewMemoryStore(), key)
+	is.NoErr(err)
+	err = old.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	new := sesh.NewMemoryStore()
+	copied, err := migratestore.New(old, new).Copy(ctx)
+	is.NoErr(err)
+	is.Equal(copied, int64(1))
+	data, _, err := new.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	// Unless the store they wrap doesn't implement it
+	old, err = cryptstore.New(filestore.New(t.TempDir()), key)
+	is.NoErr(err)
+	_, err = migratestore.New(old, new).Copy(ctx)
+	is.Equal(err.Error(), "migratestore: old store doesn't implement sesh.Lister")
+}
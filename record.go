@@ -0,0 +1,163 @@
+package sesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// record is the format sessions are stored in. The encoded session data is
+// prefixed with a small header containing metadata about the session:
+//
+//	magic (2 bytes) | header length (uvarint) | header | data
+//
+// New fields are appended to the end of the header, so records written before
+// a field existed can still be read. Data without the magic prefix was written
+// before records existed and is treated as the session data itself.
+type record struct {
+	// Transient records are stored in browser session cookies that are removed
+	// when the browser is closed.
+	Transient bool
+
+	// Created is when the session was first created
+	Created time.Time
+
+	// Schema is the version of the session data's schema
+	Schema uint64
+
+	// Data is the session data encoded by the codec
+	Data []byte
+
+	// JSON is true when the record was stored as a JSON object, so its data is
+	// plain JSON
+	JSON bool
+}
+
+// recordMagic can't be confused with the start of a gob or JSON payload
+var recordMagic = []byte{0x00, 's'}
+
+const (
+	flagTransient byte = 1 << iota
+)
+
+var errInvalidRecord = errors.New("sesh: invalid session record")
+
+func encodeRecord(r *record) []byte {
+	var flags byte
+	if r.Transient {
+		flags |= flagTransient
+	}
+	header := []byte{flags}
+	var created int64
+	if !r.Created.IsZero() {
+		created = r.Created.UnixNano()
+	}
+	header = binary.AppendVarint(header, created)
+	header = binary.AppendUvarint(header, r.Schema)
+	out := make([]byte, 0, len(recordMagic)+binary.MaxVarintLen64+len(header)+len(r.Data))
+	out = append(out, recordMagic...)
+	out = binary.AppendUvarint(out, uint64(len(header)))
+	out = append(out, header...)
+	out = append(out, r.Data...)
+	return out
+}
+
+// jsonRecord is the format sessions encoded with JSONCodec are stored in, so
+// the whole session stays readable by other tools and services. The metadata
+// sits alongside the session data in a single JSON object:
+//
+//	{"sesh":1,"created":"2080-01-01T00:00:00Z","schema":0,"data":{"UserID":7}}
+//
+// Transient sessions also have "transient":true.
+type jsonRecord struct {
+	Sesh      int             `json:"sesh"`
+	Created   *time.Time      `json:"created,omitempty"`
+	Schema    uint64          `json:"schema"`
+	Transient bool            `json:"transient,omitempty"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// jsonRecordVersion is the value of the "sesh" field in JSON records
+const jsonRecordVersion = 1
+
+// encodeJSONRecord encodes a record whose data is JSON
+func encodeJSONRecord(r *record) ([]byte, error) {
+	jr := &jsonRecord{
+		Sesh:      jsonRecordVersion,
+		Schema:    r.Schema,
+		Transient: r.Transient,
+		Data:      r.Data,
+	}
+	if !r.Created.IsZero() {
+		created := r.Created.UTC()
+		jr.Created = &created
+	}
+	return json.Marshal(jr)
+}
+
+// decodeJSONRecord decodes a JSON record. JSON without the "sesh" field was
+// stored before JSON records existed and isn't a record.
+func decodeJSONRecord(data []byte) (*record, bool, error) {
+	var jr jsonRecord
+	if err := json.Unmarshal(data, &jr); err != nil || jr.Sesh == 0 {
+		return nil, false, nil
+	}
+	if jr.Sesh != jsonRecordVersion || jr.Data == nil {
+		return nil, true, errInvalidRecord
+	}
+	r := &record{
+		Transient: jr.Transient,
+		Schema:    jr.Schema,
+		Data:      jr.Data,
+		JSON:      true,
+	}
+	if jr.Created != nil {
+		r.Created = *jr.Created
+	}
+	return r, true, nil
+}
+
+func decodeRecord(data []byte) (*record, error) {
+	if len(data) > 0 && data[0] == '{' {
+		if r, ok, err := decodeJSONRecord(data); ok {
+			return r, err
+		}
+	}
+	if !bytes.HasPrefix(data, recordMagic) {
+		return &record{Data: data}, nil
+	}
+	data = data[len(recordMagic):]
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return nil, errInvalidRecord
+	}
+	header, data := data[n:n+int(size)], data[n+int(size):]
+	r := &record{Data: data}
+	if len(header) == 0 {
+		return r, nil
+	}
+	r.Transient = header[0]&flagTransient != 0
+	header = header[1:]
+	if len(header) == 0 {
+		return r, nil
+	}
+	created, n := binary.Varint(header)
+	if n <= 0 {
+		return nil, errInvalidRecord
+	}
+	if created != 0 {
+		r.Created = time.Unix(0, created)
+	}
+	header = header[n:]
+	if len(header) == 0 {
+		return r, nil
+	}
+	schema, n := binary.Uvarint(header)
+	if n <= 0 {
+		return nil, errInvalidRecord
+	}
+	r.Schema = schema
+	return r, nil
+}
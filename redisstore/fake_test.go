@@ -0,0 +1,199 @@
+package redisstore_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server that speaks enough of the RESP protocol
+// to test the store without a running Redis
+type fakeRedis struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	keys     map[string]fakeKey
+	commands [][]string
+}
+
+type fakeKey struct {
+	value    string
+	expireAt time.Time
+}
+
+func startFakeRedis(t testing.TB) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, keys: map[string]fakeKey{}}
+	var wg sync.WaitGroup
+	var conns sync.Map
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns.Store(conn, true)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				f.serve(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		conns.Range(func(conn, _ any) bool {
+			conn.(net.Conn).Close()
+			return true
+		})
+		wg.Wait()
+	})
+	return f
+}
+
+func (f *fakeRedis) Addr() string {
+	return f.ln.Addr().String()
+}
+
+// Commands returns the commands that have been run, excluding the connection
+// handshake. Values are left out since they're binary.
+func (f *fakeRedis) Commands() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.commands...)
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.run(w, args)
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("fake redis: expected an array, got %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("fake redis: expected a bulk string, got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", errors.New("fake redis: invalid line ending")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (f *fakeRedis) run(w *bufio.Writer, args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(w, "-ERR empty command\r\n")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	name := strings.ToUpper(args[0])
+	switch name {
+	case "HELLO", "CLIENT":
+		// Respond like an older server, so the client falls back to RESP2
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+		return
+	}
+	command := append([]string{name}, args[1:]...)
+	if name == "SET" && len(command) > 2 {
+		command = append(command[:2:2], command[3:]...)
+	}
+	f.commands = append(f.commands, command)
+	switch name {
+	case "PING":
+		fmt.Fprint(w, "+PONG\r\n")
+	case "GET":
+		if len(args) != 2 {
+			fmt.Fprint(w, "-ERR wrong number of arguments for 'get' command\r\n")
+			return
+		}
+		key, ok := f.keys[args[1]]
+		if !ok || !key.expireAt.After(now) {
+			delete(f.keys, args[1])
+			fmt.Fprint(w, "$-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(key.value), key.value)
+	case "SET":
+		if len(args) != 5 || strings.ToUpper(args[3]) != "PX" {
+			fmt.Fprint(w, "-ERR syntax error\r\n")
+			return
+		}
+		ms, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil || ms <= 0 {
+			fmt.Fprint(w, "-ERR invalid expire time in 'set' command\r\n")
+			return
+		}
+		f.keys[args[1]] = fakeKey{args[2], now.Add(time.Duration(ms) * time.Millisecond)}
+		fmt.Fprint(w, "+OK\r\n")
+	case "DEL":
+		deleted := 0
+		for _, k := range args[1:] {
+			if key, ok := f.keys[k]; ok && key.expireAt.After(now) {
+				deleted++
+			}
+			delete(f.keys, k)
+		}
+		fmt.Fprintf(w, ":%d\r\n", deleted)
+	default:
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+	}
+}
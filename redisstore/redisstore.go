@@ -0,0 +1,94 @@
+package redisstore
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/matthewmueller/sesh"
+	"github.com/redis/go-redis/v9"
+)
+
+// New creates a session store backed by Redis. The client can be a single
+// node, cluster or ring client.
+func New(client redis.UniversalClient) *Store {
+	return &Store{
+		client: client,
+		Prefix: "sesh:",
+		Now:    time.Now,
+	}
+}
+
+// Store sessions in Redis. Sessions are written with SET ... PX, so Redis
+// removes expired sessions on its own and there's nothing to clean up.
+//
+// Each value holds the expiry followed by the session data:
+//
+//	expiry (unix nanoseconds, 8 bytes) | data
+type Store struct {
+	client redis.UniversalClient
+
+	// Prefix is prepended to session ids to create the Redis key
+	Prefix string
+
+	// Used for testing
+	Now func() time.Time
+}
+
+var _ sesh.Store = (*Store)(nil)
+
+const headerSize = 8
+
+var errInvalidValue = errors.New("redisstore: invalid session value")
+
+// Find returns the data for a session id from the store. If the session is not
+// found or expired, the data will be nil and the time will be zero, but there
+// will be no error.
+func (s *Store) Find(ctx context.Context, id string) (data []byte, expiry time.Time, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	value, err := s.client.Get(ctx, s.Prefix+id).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, time.Time{}, nil
+		}
+		return nil, time.Time{}, err
+	}
+	if len(value) < headerSize {
+		return nil, time.Time{}, errInvalidValue
+	}
+	expiry = time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+	// Redis expires keys with millisecond precision
+	if expiry.Before(s.Now()) {
+		return nil, time.Time{}, nil
+	}
+	return value[headerSize:], expiry, nil
+}
+
+// Upsert sets the session to expire after the time left until expiry. Sessions
+// that have already expired are deleted.
+func (s *Store) Upsert(ctx context.Context, id string, data []byte, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ttl := expiry.Sub(s.Now())
+	// Round up to the nearest millisecond
+	ttl = (ttl + time.Millisecond - 1).Truncate(time.Millisecond)
+	if ttl <= 0 {
+		return s.Delete(ctx, id)
+	}
+	value := make([]byte, 0, headerSize+len(data))
+	value = binary.BigEndian.AppendUint64(value, uint64(expiry.UnixNano()))
+	value = append(value, data...)
+	return s.client.Do(ctx, "SET", s.Prefix+id, value, "PX", ttl.Milliseconds()).Err()
+}
+
+// Delete the session. Deleting a missing session isn't an error.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.client.Del(ctx, s.Prefix+id).Err()
+}
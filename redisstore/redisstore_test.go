@@ -0,0 +1,95 @@
+package redisstore_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/redisstore"
+	"github.com/matthewmueller/sesh/storetest"
+	"github.com/redis/go-redis/v9"
+)
+
+func connect(t testing.TB, server *fakeRedis) *redis.Client {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t testing.TB) sesh.Store {
+		return redisstore.New(connect(t, startFakeRedis(t)))
+	})
+}
+
+func TestCommands(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	server := startFakeRedis(t)
+	store := redisstore.New(connect(t, server))
+	now := time.Now()
+	store.Now = func() time.Time { return now }
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), now.Add(time.Minute+time.Microsecond))
+	is.NoErr(err)
+	data, _, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	is.NoErr(store.Delete(ctx, "session_token"))
+	is.NoErr(store.Delete(ctx, "session_token"))
+	// Upserting an expired session deletes it
+	err = store.Upsert(ctx, "session_token", []byte("encoded_data"), now.Add(-time.Minute))
+	is.NoErr(err)
+	commands := server.Commands()
+	is.Equal(len(commands), 5)
+	// Expiry is rounded up to the nearest millisecond
+	is.Equal(commands[0], []string{"SET", "sesh:session_token", "PX", strconv.Itoa(60001)})
+	is.Equal(commands[1], []string{"GET", "sesh:session_token"})
+	is.Equal(commands[2], []string{"DEL", "sesh:session_token"})
+	is.Equal(commands[3], []string{"DEL", "sesh:session_token"})
+	is.Equal(commands[4], []string{"DEL", "sesh:session_token"})
+}
+
+func TestPrefix(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	server := startFakeRedis(t)
+	client := connect(t, server)
+	store := redisstore.New(client)
+	store.Prefix = "app:session:"
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	value, err := client.Get(ctx, "app:session:session_token").Bytes()
+	is.NoErr(err)
+	is.Equal(string(value[8:]), "encoded_data")
+}
+
+func TestSession(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	type Data struct {
+		UserID int
+	}
+	server := startFakeRedis(t)
+	store := redisstore.New(connect(t, server))
+	store.Prefix = "app:session:"
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.Now = func() time.Time { return now }
+	sessions := sesh.New[Data]()
+	sessions.Now = func() time.Time { return now }
+	sessions.Store = store
+	session, err := sessions.Load(ctx, "")
+	is.NoErr(err)
+	session.Data.UserID = 42
+	is.NoErr(sessions.Save(ctx, session))
+	// The session is stored under the prefix and expires along with it
+	commands := server.Commands()
+	ttl := session.Expiry.Sub(now).Milliseconds()
+	is.Equal(commands[len(commands)-1], []string{"SET", "app:session:" + session.ID, "PX", strconv.FormatInt(ttl, 10)})
+	session, err = sessions.Load(ctx, session.ID)
+	is.NoErr(err)
+	is.Equal(session.Data.UserID, 42)
+}
@@ -1,6 +1,7 @@
 package sesh
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
@@ -8,6 +9,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/felixge/httpsnoop"
 	"github.com/matthewmueller/httpbuf"
 )
 
@@ -21,11 +23,10 @@ func New[Data any]() *Manager[Data] {
 			SameSite: http.SameSiteLaxMode,
 			Path:     "/",
 			Secure:   false,
-			// TODO: need a way to be able to set a browser session cookie, yet still
-			// load sessions from the store during that session
+			Persist:  true,
 		},
-		Store:        newMemoryStore(),
-		Codec:        &gobCodec{},
+		Store:        NewMemoryStore(),
+		Codec:        &GobCodec{},
 		Now:          time.Now,
 		Generate:     generateRandom,
 		ErrorHandler: errorHandler,
@@ -47,11 +48,53 @@ type Manager[Data any] struct {
 
 	// Generate is used to generate a new session id.
 	Generate func() (string, error)
+
+	// IdleTimeout expires sessions that haven't been used for this long. When
+	// set, the expiry is extended on every request instead of expiring
+	// Cookie.ExpireIn after the session was created. Disabled by default.
+	IdleTimeout time.Duration
+
+	// Lifetime is the maximum amount of time a session can last from when it
+	// was created, regardless of activity. Disabled by default.
+	Lifetime time.Duration
+
+	// Conflict is called when the session was changed by another request after
+	// it was loaded. It's only used when the Store implements VersionedStore.
+	// Conflict receives the latest session data in the store along with this
+	// request's session data and returns the merged data to save. Return ErrRetry
+	// to run the handler again with the latest session or return any other error
+	// to pass it to the ErrorHandler. When Conflict is nil, the last write wins.
+	Conflict func(latest, current *Data) (*Data, error)
+
+	// Migrations upgrade stored session data as Data changes over time. The
+	// migration at index i upgrades session data from schema version i to i+1,
+	// so the current schema version is len(Migrations). Sessions stored before
+	// migrations were added have schema version 0. Migrations run before the
+	// session data is decoded.
+	Migrations []Migration
+
+	// DiscardInvalid starts a fresh session instead of returning an error when
+	// a stored session can't be migrated or decoded. The invalid session is
+	// removed from the store when the fresh session is saved.
+	DiscardInvalid bool
+
+	// Secrets sign the session id in the cookie with HMAC-SHA256, so forged
+	// session ids are rejected before looking them up in the store. The first
+	// secret signs cookies, while every secret is tried when verifying, so you
+	// can rotate secrets by adding a new secret to the front. Cookies without a
+	// valid signature start a new session. Session ids aren't signed by default.
+	Secrets [][]byte
+
+	// Stateless stores sessions in cookies rather than in the Store. Sessions
+	// are encrypted and authenticated with Secrets, so at least one secret is
+	// required. Sessions that don't fit within a single cookie are split across
+	// multiple cookies. Load and Save still use the Store.
+	Stateless bool
 }
 
 // Load the session from the store
 func (m *Manager[Data]) Load(ctx context.Context, id string) (*Session[*Data], error) {
-	raw, expiry, err := m.Store.Find(ctx, id)
+	raw, expiry, version, err := m.find(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -61,29 +104,153 @@ func (m *Manager[Data]) Load(ctx context.Context, id string) (*Session[*Data], e
 	} else if expiry.Before(m.Now()) {
 		return m.newSession(), nil
 	}
+	rec, err := decodeRecord(raw)
+	if err != nil {
+		return m.invalidSession(id, err)
+	}
+	// Session has outlived its lifetime
+	if m.Lifetime > 0 && !rec.Created.IsZero() && rec.Created.Add(m.Lifetime).Before(m.Now()) {
+		return m.newSession(), nil
+	}
 	// Session data found, decode it
-	data := new(Data)
-	if err := m.Codec.Decode(raw, &data); err != nil {
-		return nil, err
+	data, err := m.decode(rec)
+	if err != nil {
+		return m.invalidSession(id, err)
 	}
 	return &Session[*Data]{
-		ID:     id,
-		Data:   data,
-		Expiry: expiry,
+		ID:        id,
+		Data:      data,
+		Expiry:    expiry,
+		Created:   rec.Created,
+		transient: rec.Transient,
+		stored:    &snapshot{id, raw, expiry},
+		version:   version,
 	}, nil
 }
 
+// find the session in the store along with its version, if the store is
+// versioned
+func (m *Manager[Data]) find(ctx context.Context, id string) (raw []byte, expiry time.Time, version int64, err error) {
+	if store, ok := m.Store.(VersionedStore); ok {
+		raw, expiry, version, err = store.FindVersion(ctx, id)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return raw, expiry, version, err
+		}
+	}
+	raw, expiry, err = m.Store.Find(ctx, id)
+	return raw, expiry, 0, err
+}
+
+// invalidSession is called when the stored session can't be decoded. Either
+// return the error or start a fresh session that replaces the stored session.
+func (m *Manager[Data]) invalidSession(id string, err error) (*Session[*Data], error) {
+	if !m.DiscardInvalid {
+		return nil, err
+	}
+	session := m.newSession()
+	session.previous = id
+	return session, nil
+}
+
+// decode the session data, migrating it to the current schema first
+func (m *Manager[Data]) decode(rec *record) (*Data, error) {
+	raw, err := m.migrate(rec.Schema, rec.Data)
+	if err != nil {
+		return nil, err
+	}
+	codec := m.Codec
+	// JSON records hold plain JSON, even when the codec tags other formats
+	if rec.JSON {
+		if json, ok := jsonDecoder(m.Codec); ok {
+			codec = json
+		}
+	}
+	data := new(Data)
+	if err := codec.Decode(raw, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// encode the session into a record
+func (m *Manager[Data]) encode(session *Session[*Data]) ([]byte, error) {
+	codec, isJSON := jsonCodec(m.Codec)
+	if !isJSON {
+		codec = m.Codec
+	}
+	data, err := codec.Encode(session.Data)
+	if err != nil {
+		return nil, err
+	}
+	rec := &record{
+		Transient: session.transient,
+		Created:   session.Created,
+		Schema:    uint64(len(m.Migrations)),
+		Data:      data,
+	}
+	// Keep JSON sessions readable by storing the metadata as JSON too
+	if isJSON {
+		return encodeJSONRecord(rec)
+	}
+	return encodeRecord(rec), nil
+}
+
 func (m *Manager[Data]) newSession() *Session[*Data] {
+	now := m.Now()
 	return &Session[*Data]{
-		Data:   new(Data),
-		Expiry: m.Now().Add(m.Cookie.ExpireIn),
+		Data:      new(Data),
+		Expiry:    now.Add(m.Cookie.ExpireIn),
+		Created:   now,
+		transient: !m.Cookie.Persist,
 	}
 }
 
 type Session[Data any] struct {
-	ID     string // Will be empty if the session is new
-	Data   Data
-	Expiry time.Time
+	ID      string // Will be empty if the session is new
+	Data    Data
+	Expiry  time.Time
+	Created time.Time
+
+	// previous is the session id to remove from the store upon saving. It's set
+	// when the session id has been renewed.
+	previous string
+
+	// destroyed is set when the session should be removed from the store rather
+	// than saved.
+	destroyed bool
+
+	// transient sessions are written to browser session cookies that are
+	// removed when the browser is closed. The session still expires in the store.
+	transient bool
+
+	// stored is a snapshot of the session in the store. It's used to skip
+	// writing sessions that haven't changed. It's nil for new sessions.
+	stored *snapshot
+
+	// version of the session in a VersionedStore. It's 0 for new sessions.
+	version int64
+
+	// resign is set when the cookie was signed with an older secret
+	resign bool
+
+	// chunks is the number of cookies a stateless session was read from
+	chunks int
+}
+
+// snapshot of a session as it was loaded from or saved to the store
+type snapshot struct {
+	id     string
+	raw    []byte
+	expiry time.Time
+}
+
+// sameData returns true if the session data hasn't changed since it was
+// stored. The expiry may have changed.
+func (s *Session[Data]) sameData(raw []byte) bool {
+	return s.stored != nil &&
+		s.previous == "" &&
+		s.stored.id == s.ID &&
+		bytes.Equal(s.stored.raw, raw)
 }
 
 // generateRandom generates a random session ID.
@@ -103,26 +270,87 @@ func (m *Manager[Data]) prepareSession(session *Session[*Data]) (err error) {
 			return err
 		}
 	}
+	now := m.Now()
+	if session.Created.IsZero() {
+		session.Created = now
+	}
 	if session.Expiry.IsZero() {
-		session.Expiry = m.Now().Add(m.Cookie.ExpireIn)
+		session.Expiry = now.Add(m.Cookie.ExpireIn)
+	}
+	// Slide the expiry forward on activity
+	if m.IdleTimeout > 0 {
+		session.Expiry = now.Add(m.IdleTimeout)
+	}
+	// Never extend the session beyond its lifetime
+	if m.Lifetime > 0 {
+		if deadline := session.Created.Add(m.Lifetime); deadline.Before(session.Expiry) {
+			session.Expiry = deadline
+		}
 	}
 	return nil
 }
 
 // Save the session to the store
 func (m *Manager[Data]) Save(ctx context.Context, session *Session[*Data]) (err error) {
+	if session.destroyed {
+		return m.destroy(ctx, session)
+	}
 	if err := m.prepareSession(session); err != nil {
 		return err
 	}
-	return m.save(ctx, session)
+	_, err = m.save(ctx, session)
+	return err
 }
 
-func (m *Manager[Data]) save(ctx context.Context, session *Session[*Data]) (err error) {
-	raw, err := m.Codec.Encode(session.Data)
+// save the session to the store, returning false if the session was unchanged
+// and didn't need to be saved.
+func (m *Manager[Data]) save(ctx context.Context, session *Session[*Data]) (saved bool, err error) {
+	raw, err := m.encode(session)
 	if err != nil {
-		return err
+		return false, err
 	}
-	return m.Store.Upsert(ctx, session.ID, raw, session.Expiry)
+	if session.sameData(raw) {
+		// Nothing has changed
+		if session.stored.expiry.Equal(session.Expiry) {
+			return false, nil
+		}
+		// Only the expiry has changed
+		if toucher, ok := m.Store.(Toucher); ok {
+			if err := toucher.Touch(ctx, session.ID, session.Expiry); err != nil {
+				return false, err
+			}
+			session.stored = &snapshot{session.ID, raw, session.Expiry}
+			return true, nil
+		}
+	}
+	if raw, err = m.upsert(ctx, session, raw); err != nil {
+		return false, err
+	}
+	// Remove the old session after the new one has been stored
+	if session.previous != "" {
+		if err := m.Store.Delete(ctx, session.previous); err != nil {
+			return false, err
+		}
+		session.previous = ""
+	}
+	session.stored = &snapshot{session.ID, raw, session.Expiry}
+	return true, nil
+}
+
+// destroy removes the session and any renewed session from the store
+func (m *Manager[Data]) destroy(ctx context.Context, session *Session[*Data]) (err error) {
+	for _, id := range []string{session.ID, session.previous} {
+		if id == "" {
+			continue
+		}
+		if err := m.Store.Delete(ctx, id); err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	session.previous = ""
+	session.stored = nil
+	return nil
 }
 
 // Delete the session from the store
@@ -141,19 +369,48 @@ func errorHandler(w http.ResponseWriter, r *http.Request, err error) {
 // Middleware for loading and saving sessions
 func (m *Manager[Data]) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session, err := m.Read(r)
-		if err != nil {
-			m.ErrorHandler(w, r, err)
-			return
+		// Only Conflict can ask to retry, so only record the body when it's set
+		var body *retryBody
+		if m.Conflict != nil && r.Body != nil && r.Body != http.NoBody {
+			body = &retryBody{r: r.Body}
 		}
-		r = r.WithContext(context.WithValue(r.Context(), sessionKey, session))
-		rw := httpbuf.Wrap(w)
-		next.ServeHTTP(rw, r)
-		if err := m.Write(w, r, session); err != nil {
-			m.ErrorHandler(w, r, err)
+		for attempt := 1; ; attempt++ {
+			session, err := m.Read(r)
+			if err != nil {
+				m.ErrorHandler(w, r, err)
+				return
+			}
+			r := r.WithContext(context.WithValue(r.Context(), sessionKey, session))
+			if body != nil {
+				r.Body = body
+			}
+			rw := httpbuf.Wrap(w)
+			flushed := false
+			next.ServeHTTP(httpsnoop.Wrap(rw, httpsnoop.Hooks{
+				Flush: func(flush httpsnoop.FlushFunc) httpsnoop.FlushFunc {
+					return func() {
+						flushed = true
+						flush()
+					}
+				},
+			}), r)
+			if err := m.Write(w, r, session); err != nil {
+				if errors.Is(err, ErrRetry) && flushed {
+					err = errFlushed
+				} else if errors.Is(err, ErrRetry) && attempt < maxAttempts {
+					// Discard the response and run the handler again with the latest
+					// session
+					if body != nil {
+						body = body.rewind()
+					}
+					continue
+				}
+				m.ErrorHandler(w, r, err)
+				return
+			}
+			rw.Flush()
 			return
 		}
-		rw.Flush()
 	})
 }
 
@@ -173,6 +430,9 @@ func (m *Manager[Data]) Read(r Request) (session *Session[*Data], err error) {
 	if session, ok := r.Context().Value(sessionKey).(*Session[*Data]); ok {
 		return session, nil
 	}
+	if m.Stateless {
+		return m.readStateless(r)
+	}
 	cookie, err := r.Cookie(m.Cookie.Name)
 	if err != nil {
 		if !errors.Is(err, http.ErrNoCookie) {
@@ -180,25 +440,55 @@ func (m *Manager[Data]) Read(r Request) (session *Session[*Data], err error) {
 		}
 		return m.newSession(), nil
 	}
-	return m.Load(r.Context(), cookie.Value)
+	id, secret, ok := m.verify(cookie.Value)
+	if !ok {
+		return m.newSession(), nil
+	}
+	session, err = m.Load(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	// Re-sign cookies that were signed with an older secret
+	session.resign = secret > 0
+	return session, nil
 }
 
 // Write the session to the response
 func (m *Manager[Data]) Write(w ResponseWriter, r Request, session *Session[*Data]) (err error) {
+	if err := m.Cookie.Validate(); err != nil {
+		return err
+	}
+	if m.Stateless {
+		return m.writeStateless(w, session)
+	}
+	if session.destroyed {
+		if err := m.destroy(r.Context(), session); err != nil {
+			return err
+		}
+		// Expire the cookie in the browser
+		if v := m.Cookie.expired().String(); v != "" {
+			w.Header().Add("Set-Cookie", v)
+		}
+		return nil
+	}
 	if err := m.prepareSession(session); err != nil {
 		return err
 	}
-	if err := m.save(r.Context(), session); err != nil {
+	saved, err := m.save(r.Context(), session)
+	if err != nil {
 		return err
 	}
-	cookie := &http.Cookie{
-		Value:    session.ID,
-		Expires:  session.Expiry,
-		Name:     m.Cookie.Name,
-		HttpOnly: m.Cookie.HttpOnly,
-		SameSite: m.Cookie.SameSite,
-		Path:     m.Cookie.Path,
+	// The browser already has an up-to-date cookie
+	if !saved && !session.resign {
+		return nil
+	}
+	session.resign = false
+	expiry := session.Expiry
+	// Leave out the expiry for browser session cookies
+	if session.transient {
+		expiry = time.Time{}
 	}
+	cookie := m.Cookie.cookie(m.sign(session.ID), expiry, m.Now())
 	if v := cookie.String(); v != "" {
 		w.Header().Add("Set-Cookie", v)
 	}
@@ -214,4 +504,74 @@ func (m *Manager[Data]) Session(r Request) (session *Data) {
 	return s.Data
 }
 
-// func (m *Manager)
+// ErrNoSession is returned when there's no session within the request context.
+// This typically means the handler isn't wrapped by the middleware.
+var ErrNoSession = errors.New("sesh: no session in the request context")
+
+func (m *Manager[Data]) fromContext(r Request) (*Session[*Data], error) {
+	session, ok := r.Context().Value(sessionKey).(*Session[*Data])
+	if !ok {
+		return nil, ErrNoSession
+	}
+	return session, nil
+}
+
+// Renew the session id while keeping the session data. The old session is
+// removed from the store and a new cookie is sent when the session is written.
+// You should renew the session whenever the privilege level changes (e.g.
+// logging in) to prevent session fixation attacks.
+func (m *Manager[Data]) Renew(r Request) error {
+	session, err := m.fromContext(r)
+	if err != nil {
+		return err
+	}
+	session.Renew()
+	return nil
+}
+
+// Renew the session id while keeping the session data. The old session id will
+// be removed from the store when the session is saved.
+func (s *Session[Data]) Renew() {
+	// Keep the original id if we renew multiple times before saving
+	if s.previous == "" {
+		s.previous = s.ID
+	}
+	s.ID = ""
+	s.version = 0
+}
+
+// RememberMe sets whether the session cookie in the request context should
+// persist after the browser is closed. This overrides Cookie.Persist for this
+// session. It's typically called when logging in with a "remember me" checkbox.
+func (m *Manager[Data]) RememberMe(r Request, remember bool) error {
+	session, err := m.fromContext(r)
+	if err != nil {
+		return err
+	}
+	session.RememberMe(remember)
+	return nil
+}
+
+// RememberMe sets whether the session cookie should persist after the browser
+// is closed. The choice is stored alongside the session.
+func (s *Session[Data]) RememberMe(remember bool) {
+	s.transient = !remember
+}
+
+// Destroy the session in the request context. Once the handler returns, the
+// session is removed from the store and the session cookie is expired. Use this
+// to log users out.
+func (m *Manager[Data]) Destroy(r Request) error {
+	session, err := m.fromContext(r)
+	if err != nil {
+		return err
+	}
+	session.Destroy()
+	return nil
+}
+
+// Destroy the session. The session will be removed from the store rather than
+// saved.
+func (s *Session[Data]) Destroy() {
+	s.destroyed = true
+}
@@ -3,12 +3,19 @@ package sesh_test
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/http/httputil"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -397,11 +404,11 @@ func TestFlash(t *testing.T) {
 
 		validation error
 	`)
+	// The session is unchanged, so there's no need to set the cookie again
 	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
 	equal(t, jar, handler, req, `
 		HTTP/1.1 200 OK
 		Connection: close
-		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
 	`)
 }
 
@@ -488,3 +495,1313 @@ func TestErrorHandler(t *testing.T) {
 		oh noz
 	`)
 }
+
+func TestRenew(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	ids := 0
+	sessions.Generate = func() (string, error) {
+		ids++
+		return "random_id_" + strconv.Itoa(ids), nil
+	}
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		if r.URL.Path == "/login" {
+			is.NoErr(sessions.Renew(r))
+		}
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id_1; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/login", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id_2; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		2
+	`)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id_2; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		3
+	`)
+	// The old session id no longer exists
+	session, err := sessions.Load(context.Background(), "random_id_1")
+	is.NoErr(err)
+	is.Equal(session.ID, "")
+	is.Equal(session.Data.Visits, 0)
+}
+
+func TestRenewOutsideMiddleware(t *testing.T) {
+	is := is.New(t)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	is.True(errors.Is(sessions.Renew(req), sesh.ErrNoSession))
+}
+
+func TestDestroy(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	ids := 0
+	sessions.Generate = func() (string, error) {
+		ids++
+		return "random_id_" + strconv.Itoa(ids), nil
+	}
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		if r.URL.Path == "/logout" {
+			is.NoErr(sessions.Destroy(r))
+		}
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id_1; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/logout", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=; Path=/; Max-Age=0; HttpOnly; SameSite=Lax
+
+		2
+	`)
+	// The session was removed from the store
+	session, err := sessions.Load(context.Background(), "random_id_1")
+	is.NoErr(err)
+	is.Equal(session.ID, "")
+	is.Equal(session.Data.Visits, 0)
+	// The next request starts a new session
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id_2; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+}
+
+func TestDestroyRenewed(t *testing.T) {
+	is := is.New(t)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	ctx := context.Background()
+	session, err := sessions.Load(ctx, "")
+	is.NoErr(err)
+	session.Data.Visits = 1
+	is.NoErr(sessions.Save(ctx, session))
+	id := session.ID
+	session.Renew()
+	session.Destroy()
+	is.NoErr(sessions.Save(ctx, session))
+	loaded, err := sessions.Load(ctx, id)
+	is.NoErr(err)
+	is.Equal(loaded.ID, "")
+	is.Equal(loaded.Data.Visits, 0)
+}
+
+func TestCookieAttributes(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	sessions.Cookie.Domain = "example.com"
+	sessions.Cookie.Secure = true
+	sessions.Cookie.SameSite = http.SameSiteNoneMode
+	sessions.Cookie.Partitioned = true
+	sessions.Cookie.MaxAge = true
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Domain=example.com; Expires=Mon, 08 Jan 2080 00:00:00 GMT; Max-Age=604800; HttpOnly; Secure; SameSite=None; Partitioned
+
+		1
+	`)
+}
+
+func TestCookieValidate(t *testing.T) {
+	is := is.New(t)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	is.NoErr(sessions.Cookie.Validate())
+	sessions.Cookie.SameSite = http.SameSiteNoneMode
+	is.Equal(sessions.Cookie.Validate().Error(), "sesh: cookies with SameSite=None must be Secure")
+	sessions.Cookie.Secure = true
+	is.NoErr(sessions.Cookie.Validate())
+	sessions.Cookie.Secure = false
+	sessions.Cookie.SameSite = http.SameSiteLaxMode
+	sessions.Cookie.Partitioned = true
+	is.Equal(sessions.Cookie.Validate().Error(), "sesh: partitioned cookies must be Secure")
+	sessions.Cookie.Partitioned = false
+	sessions.Cookie.Name = "s id"
+	is.True(sessions.Cookie.Validate() != nil)
+	sessions.Cookie.Name = ""
+	is.Equal(sessions.Cookie.Validate().Error(), "sesh: cookie name must not be empty")
+	// Invalid cookies are passed to the error handler
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	is.Equal(rec.Code, http.StatusInternalServerError)
+	is.Equal(rec.Header().Get("Set-Cookie"), "")
+}
+
+func TestRememberMe(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	sessions.Cookie.Persist = false
+	sessions.Cookie.MaxAge = true
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		switch r.URL.Path {
+		case "/login":
+			is.NoErr(sessions.RememberMe(r, true))
+		case "/forget":
+			is.NoErr(sessions.RememberMe(r, false))
+		}
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; HttpOnly; SameSite=Lax
+
+		1
+	`)
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/login", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; Max-Age=604800; HttpOnly; SameSite=Lax
+
+		2
+	`)
+	// Remembered across requests
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; Max-Age=604800; HttpOnly; SameSite=Lax
+
+		3
+	`)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/forget", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; HttpOnly; SameSite=Lax
+
+		4
+	`)
+	// The session still expires in the store
+	session, err := sessions.Load(context.Background(), "random_id")
+	is.NoErr(err)
+	is.Equal(session.Data.Visits, 4)
+	is.Equal(session.Expiry, futureDate().Add(sessions.Cookie.ExpireIn))
+}
+
+func TestLoadLegacy(t *testing.T) {
+	is := is.New(t)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	// Sessions stored before metadata was added only contain the encoded data
+	raw, err := sesh.New[Data]().Codec.Encode(&Data{Visits: 3})
+	is.NoErr(err)
+	mock := mockstore.New()
+	mock.MockFind = func(ctx context.Context, id string) ([]byte, time.Time, error) {
+		return raw, futureDate().Add(time.Hour), nil
+	}
+	sessions.Store = mock
+	session, err := sessions.Load(context.Background(), "random_id")
+	is.NoErr(err)
+	is.Equal(session.ID, "random_id")
+	is.Equal(session.Data.Visits, 3)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	now := futureDate()
+	sessions.Now = func() time.Time { return now }
+	ids := 0
+	sessions.Generate = func() (string, error) {
+		ids++
+		return "random_id_" + strconv.Itoa(ids), nil
+	}
+	sessions.IdleTimeout = 30 * time.Minute
+	sessions.Lifetime = 12 * time.Hour
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id_1; Path=/; Expires=Mon, 01 Jan 2080 00:30:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+	// Activity extends the expiry
+	now = now.Add(20 * time.Minute)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id_1; Path=/; Expires=Mon, 01 Jan 2080 00:50:00 GMT; HttpOnly; SameSite=Lax
+
+		2
+	`)
+	// Inactivity expires the session
+	now = now.Add(31 * time.Minute)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id_2; Path=/; Expires=Mon, 01 Jan 2080 01:21:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+	// Stay active right up until the lifetime is reached
+	for i := 0; i < 35; i++ {
+		now = now.Add(20 * time.Minute)
+		req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		rec := httptest.NewRecorder()
+		for _, cookie := range jar.Cookies(req.URL) {
+			req.AddCookie(cookie)
+		}
+		handler.ServeHTTP(rec, req)
+		jar.SetCookies(req.URL, rec.Result().Cookies())
+		is.Equal(rec.Body.String(), strconv.Itoa(i+2))
+	}
+	// The expiry is capped by the lifetime
+	now = now.Add(20 * time.Minute)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id_2; Path=/; Expires=Mon, 01 Jan 2080 12:51:00 GMT; HttpOnly; SameSite=Lax
+
+		37
+	`)
+	// Once the lifetime is reached, a new session is started
+	now = now.Add(5 * time.Minute)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id_3; Path=/; Expires=Mon, 01 Jan 2080 13:26:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+}
+
+func TestUnchanged(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	upserts := 0
+	store := sessions.Store
+	mock := mockstore.New()
+	mock.MockFind = store.Find
+	mock.MockDelete = store.Delete
+	mock.MockUpsert = func(ctx context.Context, id string, data []byte, expiry time.Time) error {
+		upserts++
+		return store.Upsert(ctx, id, data, expiry)
+	}
+	sessions.Store = mock
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		if r.Method == http.MethodPost {
+			session.Visits++
+		}
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		0
+	`)
+	is.Equal(upserts, 1)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+
+		0
+	`)
+	is.Equal(upserts, 1)
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+	is.Equal(upserts, 2)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+
+		1
+	`)
+	is.Equal(upserts, 2)
+}
+
+type touchStore struct {
+	*mockstore.Store
+	MockTouch func(ctx context.Context, id string, expiry time.Time) error
+}
+
+func (s *touchStore) Touch(ctx context.Context, id string, expiry time.Time) error {
+	return s.MockTouch(ctx, id, expiry)
+}
+
+func TestTouch(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	now := futureDate()
+	sessions.Now = func() time.Time { return now }
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	sessions.IdleTimeout = 30 * time.Minute
+	upserts, touches := 0, 0
+	store := sessions.Store
+	mock := &touchStore{Store: mockstore.New()}
+	mock.MockFind = store.Find
+	mock.MockDelete = store.Delete
+	mock.MockUpsert = func(ctx context.Context, id string, data []byte, expiry time.Time) error {
+		upserts++
+		return store.Upsert(ctx, id, data, expiry)
+	}
+	mock.MockTouch = func(ctx context.Context, id string, expiry time.Time) error {
+		touches++
+		return store.(sesh.Toucher).Touch(ctx, id, expiry)
+	}
+	sessions.Store = mock
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 01 Jan 2080 00:30:00 GMT; HttpOnly; SameSite=Lax
+
+		0
+	`)
+	is.Equal(upserts, 1)
+	is.Equal(touches, 0)
+	now = now.Add(20 * time.Minute)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 01 Jan 2080 00:50:00 GMT; HttpOnly; SameSite=Lax
+
+		0
+	`)
+	is.Equal(upserts, 1)
+	is.Equal(touches, 1)
+	// The expiry was extended in the store
+	now = now.Add(25 * time.Minute)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 01 Jan 2080 01:15:00 GMT; HttpOnly; SameSite=Lax
+
+		0
+	`)
+	is.Equal(upserts, 1)
+	is.Equal(touches, 2)
+}
+
+func TestConflictMerge(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Cart []string
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	sessions.Conflict = func(latest, current *Data) (*Data, error) {
+		// Keep items added by both requests
+		for _, item := range current.Cart {
+			if !slices.Contains(latest.Cart, item) {
+				latest.Cart = append(latest.Cart, item)
+			}
+		}
+		return latest, nil
+	}
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		item := r.URL.Query().Get("item")
+		session.Cart = append(session.Cart, item)
+		if item == "apple" {
+			// Simulate another request adding to the cart at the same time
+			other, err := sessions.Load(r.Context(), "random_id")
+			is.NoErr(err)
+			other.Data.Cart = append(other.Data.Cart, "pear")
+			is.NoErr(sessions.Save(r.Context(), other))
+		}
+		w.Write([]byte(strings.Join(session.Cart, ",")))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/?item=banana", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		banana
+	`)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/?item=apple", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		banana,apple
+	`)
+	session, err := sessions.Load(context.Background(), "random_id")
+	is.NoErr(err)
+	is.Equal(session.Data.Cart, []string{"banana", "pear", "apple"})
+}
+
+func TestConflictRetry(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Cart []string
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	sessions.Conflict = func(latest, current *Data) (*Data, error) {
+		return nil, sesh.ErrRetry
+	}
+	runs := 0
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		session := sessions.Session(r)
+		item := r.URL.Query().Get("item")
+		session.Cart = append(session.Cart, item)
+		if item == "apple" && runs == 2 {
+			// Simulate another request adding to the cart at the same time
+			other, err := sessions.Load(r.Context(), "random_id")
+			is.NoErr(err)
+			other.Data.Cart = append(other.Data.Cart, "pear")
+			is.NoErr(sessions.Save(r.Context(), other))
+		}
+		w.Write([]byte(strings.Join(session.Cart, ",")))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/?item=banana", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		banana
+	`)
+	is.Equal(runs, 1)
+	// The first response is discarded and the handler runs again
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/?item=apple", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		banana,pear,apple
+	`)
+	is.Equal(runs, 3)
+}
+
+func TestConflictRetryBody(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Cart []string
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	sessions.Conflict = func(latest, current *Data) (*Data, error) {
+		return nil, sesh.ErrRetry
+	}
+	var bodies []string
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		is.NoErr(err)
+		bodies = append(bodies, string(body))
+		session := sessions.Session(r)
+		session.Cart = append(session.Cart, string(body))
+		if len(bodies) == 2 {
+			// Simulate another request adding to the cart at the same time
+			other, err := sessions.Load(r.Context(), "random_id")
+			is.NoErr(err)
+			other.Data.Cart = append(other.Data.Cart, "pear")
+			is.NoErr(sessions.Save(r.Context(), other))
+		}
+		w.Write([]byte(strings.Join(session.Cart, ",")))
+	}))
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("banana"))
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		banana
+	`)
+	// The retried handler reads the whole body again
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("apple"))
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		banana,pear,apple
+	`)
+	is.Equal(bodies, []string{"banana", "apple", "apple"})
+}
+
+func TestConflictRetryFlushed(t *testing.T) {
+	is := is.New(t)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	sessions.Conflict = func(latest, current *Data) (*Data, error) {
+		return nil, sesh.ErrRetry
+	}
+	var handlerErr error
+	sessions.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		handlerErr = err
+	}
+	runs := 0
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		session := sessions.Session(r)
+		session.Visits++
+		// Simulate another request changing the session at the same time
+		other, err := sessions.Load(r.Context(), "random_id")
+		is.NoErr(err)
+		other.Data.Visits = 10
+		is.NoErr(sessions.Save(r.Context(), other))
+		w.Write([]byte("streamed"))
+		w.(http.Flusher).Flush()
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	// The response was already sent, so the handler isn't run again
+	is.Equal(runs, 1)
+	is.Equal(rec.Body.String(), "streamed")
+	is.Equal(handlerErr.Error(), "sesh: can't retry the request after the response was flushed")
+}
+
+func TestConflictError(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	sessions.Conflict = func(latest, current *Data) (*Data, error) {
+		return nil, sesh.ErrConflict
+	}
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		if session.Visits == 2 {
+			other, err := sessions.Load(r.Context(), "random_id")
+			is.NoErr(err)
+			other.Data.Visits = 10
+			is.NoErr(sessions.Save(r.Context(), other))
+		}
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 500 Internal Server Error
+		Connection: close
+		Content-Type: text/plain; charset=utf-8
+		X-Content-Type-Options: nosniff
+
+		sesh: session was changed by another request
+	`)
+	session, err := sessions.Load(context.Background(), "random_id")
+	is.NoErr(err)
+	is.Equal(session.Data.Visits, 10)
+}
+
+func TestJSONCodec(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int    `json:"visits"`
+		Name   string `json:"name,omitempty"`
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	sessions.Codec = sesh.JSONCodec{}
+	var stored []byte
+	store := sessions.Store
+	mock := mockstore.New()
+	mock.MockFind = store.Find
+	mock.MockDelete = store.Delete
+	mock.MockUpsert = func(ctx context.Context, id string, data []byte, expiry time.Time) error {
+		stored = data
+		return store.Upsert(ctx, id, data, expiry)
+	}
+	sessions.Store = mock
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+	is.Equal(string(stored), `{"sesh":1,"created":"2080-01-01T00:00:00Z","schema":0,"data":{"visits":1}}`)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		2
+	`)
+	is.Equal(string(stored), `{"sesh":1,"created":"2080-01-01T00:00:00Z","schema":0,"data":{"visits":2}}`)
+}
+
+func TestJSONRecord(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	type Data struct {
+		Visits int `json:"visits"`
+	}
+	store := sesh.NewMemoryStore()
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Codec = sesh.JSONCodec{}
+	sessions.Store = store
+	session, err := sessions.Load(ctx, "")
+	is.NoErr(err)
+	session.Data.Visits = 1
+	session.RememberMe(false)
+	is.NoErr(sessions.Save(ctx, session))
+	raw, _, err := store.Find(ctx, session.ID)
+	is.NoErr(err)
+	is.Equal(string(raw), `{"sesh":1,"created":"2080-01-01T00:00:00Z","schema":0,"transient":true,"data":{"visits":1}}`)
+	session, err = sessions.Load(ctx, session.ID)
+	is.NoErr(err)
+	is.Equal(session.Data.Visits, 1)
+	is.True(session.Created.Equal(futureDate()))
+	// JSON stored without the record is the session data itself
+	err = store.Upsert(ctx, "legacy_id", []byte(`{"visits":3}`), futureDate().Add(time.Hour))
+	is.NoErr(err)
+	session, err = sessions.Load(ctx, "legacy_id")
+	is.NoErr(err)
+	is.Equal(session.Data.Visits, 3)
+	// Unsupported record versions are invalid
+	err = store.Upsert(ctx, "future_id", []byte(`{"sesh":2,"data":{"visits":3}}`), futureDate().Add(time.Hour))
+	is.NoErr(err)
+	_, err = sessions.Load(ctx, "future_id")
+	is.Equal(err.Error(), "sesh: invalid session record")
+}
+
+func TestJSONCodecUnknownFields(t *testing.T) {
+	is := is.New(t)
+	type Data struct {
+		Visits int `json:"visits"`
+	}
+	data := new(Data)
+	err := sesh.JSONCodec{}.Decode([]byte(`{"visits":1,"name":"alice"}`), data)
+	is.NoErr(err)
+	is.Equal(data.Visits, 1)
+	err = sesh.JSONCodec{DisallowUnknownFields: true}.Decode([]byte(`{"visits":1,"name":"alice"}`), data)
+	is.Equal(err.Error(), `json: unknown field "name"`)
+	var v map[string]any
+	err = sesh.JSONCodec{UseNumber: true}.Decode([]byte(`{"visits":1}`), &v)
+	is.NoErr(err)
+	is.Equal(v["visits"], json.Number("1"))
+}
+
+func TestVersionedCodec(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int `json:"visits"`
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	var stored []byte
+	store := sessions.Store
+	mock := mockstore.New()
+	mock.MockFind = store.Find
+	mock.MockDelete = store.Delete
+	mock.MockUpsert = func(ctx context.Context, id string, data []byte, expiry time.Time) error {
+		stored = data
+		return store.Upsert(ctx, id, data, expiry)
+	}
+	sessions.Store = mock
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	// Stored with the default gob codec
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+	// Switch to JSON, while still reading the existing gob sessions
+	sessions.Codec = &sesh.VersionedCodec{
+		Format:   "json",
+		Codec:    sesh.JSONCodec{},
+		Untagged: sesh.GobCodec{},
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		2
+	`)
+	// JSON sessions are stored as plain JSON without a codec format
+	is.Equal(string(stored), `{"sesh":1,"created":"2080-01-01T00:00:00Z","schema":0,"data":{"visits":2}}`)
+	// Switch to a new format, while still reading the JSON sessions
+	sessions.Codec = &sesh.VersionedCodec{
+		Format: "gob",
+		Codec:  sesh.GobCodec{},
+		Formats: map[string]sesh.Codec{
+			"json": sesh.JSONCodec{},
+		},
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		3
+	`)
+	is.True(bytes.Contains(stored, []byte("\x00v\x03gob")))
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		4
+	`)
+}
+
+func TestVersionedCodecToJSON(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int `json:"visits"`
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	visit := func(visits string) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		equal(t, jar, handler, req, `
+			HTTP/1.1 200 OK
+			Connection: close
+			Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+			`+visits+`
+		`)
+	}
+	// Stored with the default gob codec
+	visit("1")
+	// Move from gob to JSON
+	sessions.Codec = &sesh.VersionedCodec{
+		Format:   "json",
+		Codec:    sesh.JSONCodec{},
+		Untagged: sesh.GobCodec{},
+	}
+	visit("2")
+	// Once the gob sessions are gone, the JSON codec reads the stored sessions
+	sessions.Codec = sesh.JSONCodec{}
+	visit("3")
+	// Sessions tagged as JSON can still be decoded by the versioned codec
+	codec := &sesh.VersionedCodec{Format: "json", Codec: sesh.JSONCodec{}}
+	data := new(Data)
+	is.NoErr(codec.Decode([]byte("\x00v\x04json"+`{"visits":4}`), data))
+	is.Equal(data.Visits, 4)
+}
+
+func TestVersionedCodecErrors(t *testing.T) {
+	is := is.New(t)
+	type Data struct {
+		Visits int `json:"visits"`
+	}
+	codec := &sesh.VersionedCodec{
+		Format: "json",
+		Codec:  sesh.JSONCodec{},
+	}
+	data := new(Data)
+	err := codec.Decode([]byte(`{"visits":1}`), data)
+	is.Equal(err.Error(), "sesh: session is missing a codec format")
+	err = codec.Decode([]byte("\x00v\x03gob"), data)
+	is.Equal(err.Error(), `sesh: unknown codec format "gob"`)
+	err = codec.Decode([]byte("\x00v\x09gob"), data)
+	is.Equal(err.Error(), "sesh: invalid codec format")
+	_, err = (&sesh.VersionedCodec{Codec: sesh.JSONCodec{}}).Encode(data)
+	is.Equal(err.Error(), `sesh: invalid codec format ""`)
+}
+
+func TestMigrations(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	store := sesh.NewMemoryStore()
+	// Original session data
+	type DataV0 struct {
+		Name string `json:"name"`
+	}
+	sessionsV0 := sesh.New[DataV0]()
+	sessionsV0.Now = futureDate
+	sessionsV0.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	sessionsV0.Codec = sesh.JSONCodec{}
+	sessionsV0.Store = store
+	handler := sessionsV0.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessionsV0.Session(r)
+		session.Name = "Alice Smith"
+		w.Write([]byte(session.Name))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		Alice Smith
+	`)
+	// The name was split into first and last names
+	type DataV1 struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+	}
+	sessions := sesh.New[DataV1]()
+	sessions.Now = futureDate
+	sessions.Codec = sesh.JSONCodec{}
+	sessions.Store = store
+	sessions.Migrations = []sesh.Migration{
+		func(data []byte) ([]byte, error) {
+			v0 := new(DataV0)
+			if err := json.Unmarshal(data, v0); err != nil {
+				return nil, err
+			}
+			first, last, _ := strings.Cut(v0.Name, " ")
+			return json.Marshal(&DataV1{first, last})
+		},
+	}
+	handler = sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		w.Write([]byte(session.LastName + ", " + session.FirstName))
+	}))
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		Smith, Alice
+	`)
+	// Once migrated, the session isn't migrated again
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+
+		Smith, Alice
+	`)
+	// Rolling back fails because the session schema is newer
+	_, err = sessionsV0.Load(context.Background(), "random_id")
+	is.Equal(err.Error(), "sesh: session schema version 1 is newer than 0")
+}
+
+func TestDiscardInvalid(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int `json:"visits"`
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	ids := 0
+	sessions.Generate = func() (string, error) {
+		ids++
+		return "random_id_" + strconv.Itoa(ids), nil
+	}
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id_1; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+	// Switching codecs makes the gob session unreadable
+	sessions.Codec = sesh.JSONCodec{}
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 500 Internal Server Error
+		Connection: close
+		Content-Type: text/plain; charset=utf-8
+		X-Content-Type-Options: nosniff
+
+		invalid character '\x1d' looking for beginning of value
+	`)
+	// Start a fresh session instead
+	sessions.DiscardInvalid = true
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id_2; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+	// The invalid session was removed
+	data, _, err := sessions.Store.Find(context.Background(), "random_id_1")
+	is.NoErr(err)
+	is.Equal(data, nil)
+}
+
+func TestCompressCodec(t *testing.T) {
+	is := is.New(t)
+	type Data struct {
+		Wizard string `json:"wizard"`
+	}
+	codec := &sesh.CompressCodec{
+		Codec:   sesh.JSONCodec{},
+		MinSize: 100,
+	}
+	// Small sessions aren't compressed
+	small, err := codec.Encode(&Data{Wizard: "step 1"})
+	is.NoErr(err)
+	is.Equal(string(small), `{"wizard":"step 1"}`)
+	data := new(Data)
+	is.NoErr(codec.Decode(small, data))
+	is.Equal(data.Wizard, "step 1")
+	// Large sessions are compressed
+	wizard := strings.Repeat("step 1, ", 1000)
+	large, err := codec.Encode(&Data{Wizard: wizard})
+	is.NoErr(err)
+	is.True(bytes.HasPrefix(large, []byte("\x00z")))
+	is.True(len(large) < len(wizard)/10)
+	data = new(Data)
+	is.NoErr(codec.Decode(large, data))
+	is.Equal(data.Wizard, wizard)
+	// Sessions stored before compression can still be read
+	data = new(Data)
+	is.NoErr(codec.Decode([]byte(`{"wizard":"`+wizard+`"}`), data))
+	is.Equal(data.Wizard, wizard)
+}
+
+func TestCompressCodecSession(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits      int
+		Permissions []string
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	sessions.Codec = &sesh.CompressCodec{Codec: sesh.GobCodec{}}
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		session.Permissions = append(session.Permissions, "read", "write")
+		w.Write([]byte(strconv.Itoa(len(session.Permissions))))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		2
+	`)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=random_id; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		4
+	`)
+}
+
+func signID(secret, name, id string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(name + "\x00" + id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func TestSigned(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	ids := 0
+	sessions.Generate = func() (string, error) {
+		ids++
+		return "random_id_" + strconv.Itoa(ids), nil
+	}
+	sessions.Secrets = [][]byte{[]byte("secret")}
+	finds := 0
+	store := sessions.Store
+	mock := mockstore.New()
+	mock.MockFind = func(ctx context.Context, id string) ([]byte, time.Time, error) {
+		finds++
+		return store.Find(ctx, id)
+	}
+	mock.MockUpsert = store.Upsert
+	mock.MockDelete = store.Delete
+	sessions.Store = mock
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=`+signID("secret", "sid", "random_id_1")+`; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		1
+	`)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=`+signID("secret", "sid", "random_id_1")+`; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		2
+	`)
+	is.Equal(finds, 1)
+	// Forged and unsigned session ids never reach the store
+	for _, value := range []string{
+		"random_id_1",
+		"random_id_1.",
+		"random_id_1.invalid",
+		signID("wrong", "sid", "random_id_1"),
+		signID("secret", "other", "random_id_1"),
+	} {
+		req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.AddCookie(&http.Cookie{Name: "sid", Value: value})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		is.Equal(rec.Body.String(), "1")
+	}
+	is.Equal(finds, 1)
+}
+
+func TestSignedRotate(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Visits int
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Generate = func() (string, error) {
+		return "random_id", nil
+	}
+	sessions.Secrets = [][]byte{[]byte("old")}
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=`+signID("old", "sid", "random_id")+`; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		0
+	`)
+	// Rotate the secret, re-signing the cookie even though the session is unchanged
+	sessions.Secrets = [][]byte{[]byte("new"), []byte("old")}
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+		Set-Cookie: sid=`+signID("new", "sid", "random_id")+`; Path=/; Expires=Mon, 08 Jan 2080 00:00:00 GMT; HttpOnly; SameSite=Lax
+
+		0
+	`)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	equal(t, jar, handler, req, `
+		HTTP/1.1 200 OK
+		Connection: close
+
+		0
+	`)
+}
@@ -0,0 +1,342 @@
+package shardstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/internal/storeutil"
+)
+
+// Number of points each shard has on the ring. More points spread sessions
+// more evenly across shards.
+const replicas = 128
+
+// New creates a store that spreads sessions across shards by consistent
+// hashing. Shards are placed on the ring by name, so keep the names stable
+// across restarts.
+func New(shards map[string]sesh.Store) (*Store, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("shardstore: at least one shard is required")
+	}
+	copied := make(map[string]sesh.Store, len(shards))
+	for name, store := range shards {
+		copied[name] = store
+	}
+	return &Store{
+		shards: copied,
+		ring:   newRing(copied),
+	}, nil
+}
+
+// Store routes each session to one of several shards. When a shard is added,
+// some sessions move to the new shard. Until FinishMigration is called,
+// sessions that aren't found on their new shard are read from the shard that
+// owned them before.
+type Store struct {
+	mu       sync.RWMutex
+	shards   map[string]sesh.Store
+	ring     *ring
+	previous []*ring // Most recent first
+}
+
+var _ sesh.Store = (*Store)(nil)
+var _ sesh.Toucher = (*Store)(nil)
+var _ sesh.VersionedStore = (*Store)(nil)
+var _ sesh.Lister = (*Store)(nil)
+
+type point struct {
+	hash  uint64
+	shard string
+}
+
+// ring of shard points sorted by hash
+type ring struct {
+	points []point
+}
+
+func newRing(shards map[string]sesh.Store) *ring {
+	r := &ring{}
+	for name := range shards {
+		for i := 0; i < replicas; i++ {
+			r.points = append(r.points, point{hash(name + "#" + strconv.Itoa(i)), name})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].shard < r.points[j].shard
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// owner returns the name of the shard that owns the id
+func (r *ring) owner(id string) string {
+	h := hash(id)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+func hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Shard returns the name of the shard that owns the session id
+func (s *Store) Shard(id string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ring.owner(id)
+}
+
+// owners returns the shard that owns the id, followed by the distinct shards
+// that owned it before. Must be called with the lock.
+func (s *Store) owners(id string) (owner sesh.Store, previous []sesh.Store) {
+	name := s.ring.owner(id)
+	seen := map[string]bool{name: true}
+	for _, r := range s.previous {
+		prev := r.owner(id)
+		if seen[prev] {
+			continue
+		}
+		seen[prev] = true
+		previous = append(previous, s.shards[prev])
+	}
+	return s.shards[name], previous
+}
+
+// Add a shard. Sessions owned by the new shard are read from their previous
+// shard until they're written again or FinishMigration is called.
+func (s *Store) Add(name string, store sesh.Store) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.shards[name]; ok {
+		return fmt.Errorf("shardstore: shard %q already exists", name)
+	}
+	shards := make(map[string]sesh.Store, len(s.shards)+1)
+	for n, store := range s.shards {
+		shards[n] = store
+	}
+	shards[name] = store
+	s.previous = append([]*ring{s.ring}, s.previous...)
+	s.shards = shards
+	s.ring = newRing(shards)
+	return nil
+}
+
+// FinishMigration stops reading sessions from their previous shards. Call it
+// once sessions written before the last Add have expired.
+func (s *Store) FinishMigration() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.previous = nil
+}
+
+// Find the session on its shard, falling back to the shards that owned it
+// before
+func (s *Store) Find(ctx context.Context, id string) (data []byte, expiry time.Time, err error) {
+	s.mu.RLock()
+	owner, previous := s.owners(id)
+	s.mu.RUnlock()
+	data, expiry, err = owner.Find(ctx, id)
+	if err != nil || data != nil {
+		return data, expiry, err
+	}
+	for _, store := range previous {
+		data, expiry, err = store.Find(ctx, id)
+		if err != nil || data != nil {
+			return data, expiry, err
+		}
+	}
+	return nil, time.Time{}, nil
+}
+
+// Upsert writes the session to its shard, removing it from the shards that
+// owned it before
+func (s *Store) Upsert(ctx context.Context, id string, data []byte, expiry time.Time) error {
+	s.mu.RLock()
+	owner, previous := s.owners(id)
+	s.mu.RUnlock()
+	if err := owner.Upsert(ctx, id, data, expiry); err != nil {
+		return err
+	}
+	return remove(ctx, id, previous)
+}
+
+// remove the session from each of the stores
+func remove(ctx context.Context, id string, stores []sesh.Store) error {
+	for _, store := range stores {
+		if err := store.Delete(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindVersion is like Find, but also returns the version of the session. While
+// migrating, a session found on a previous shard is moved to its shard first,
+// so the version comes from its shard. It returns errors.ErrUnsupported if the
+// session's shard isn't versioned.
+func (s *Store) FindVersion(ctx context.Context, id string) (data []byte, expiry time.Time, version int64, err error) {
+	s.mu.RLock()
+	owner, previous := s.owners(id)
+	s.mu.RUnlock()
+	versioned, ok := owner.(sesh.VersionedStore)
+	if !ok {
+		return nil, time.Time{}, 0, errors.ErrUnsupported
+	}
+	data, expiry, version, err = versioned.FindVersion(ctx, id)
+	if err != nil || data != nil {
+		return data, expiry, version, err
+	}
+	if len(previous) == 0 {
+		return nil, time.Time{}, 0, nil
+	}
+	if err := move(ctx, id, owner, previous); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	return versioned.FindVersion(ctx, id)
+}
+
+// move the session from the first previous shard that has it to its shard,
+// unless it was written to its shard meanwhile
+func move(ctx context.Context, id string, owner sesh.Store, previous []sesh.Store) error {
+	for _, store := range previous {
+		data, expiry, err := store.Find(ctx, id)
+		if err != nil {
+			return err
+		} else if data == nil {
+			continue
+		}
+		inserted, err := insert(ctx, owner, id, data, expiry)
+		if err != nil {
+			return err
+		}
+		if inserted {
+			// A concurrent Delete may have removed the session after it was read
+			// from the previous shard, so undo the move rather than bring it back
+			existing, _, err := store.Find(ctx, id)
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				return owner.Delete(ctx, id)
+			}
+		}
+		return remove(ctx, id, previous)
+	}
+	return nil
+}
+
+// insert the session into the store, unless it's already there
+func insert(ctx context.Context, store sesh.Store, id string, data []byte, expiry time.Time) (inserted bool, err error) {
+	// Versioned stores can insert the session without overwriting a newer write
+	if versioned, ok := store.(sesh.VersionedStore); ok {
+		err := versioned.UpsertIfVersion(ctx, id, data, expiry, 0)
+		if err == nil {
+			return true, nil
+		} else if errors.Is(err, sesh.ErrConflict) {
+			return false, nil
+		} else if !errors.Is(err, errors.ErrUnsupported) {
+			return false, err
+		}
+	}
+	existing, _, err := store.Find(ctx, id)
+	if err != nil {
+		return false, err
+	} else if existing != nil {
+		return false, nil
+	}
+	if err := store.Upsert(ctx, id, data, expiry); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UpsertIfVersion is like Upsert, but returns sesh.ErrConflict if the session
+// has been changed since version. It returns errors.ErrUnsupported if the
+// session's shard isn't versioned.
+func (s *Store) UpsertIfVersion(ctx context.Context, id string, data []byte, expiry time.Time, version int64) error {
+	s.mu.RLock()
+	owner, previous := s.owners(id)
+	s.mu.RUnlock()
+	versioned, ok := owner.(sesh.VersionedStore)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	if err := versioned.UpsertIfVersion(ctx, id, data, expiry, version); err != nil {
+		return err
+	}
+	return remove(ctx, id, previous)
+}
+
+// Delete the session from the shards that owned it before and its shard. The
+// previous shards go first, so a concurrent move that copies the session
+// afterwards sees that it's gone and removes its copy.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	s.mu.RLock()
+	owner, previous := s.owners(id)
+	s.mu.RUnlock()
+	if err := remove(ctx, id, previous); err != nil {
+		return err
+	}
+	return owner.Delete(ctx, id)
+}
+
+// Touch updates the expiry of the session on its shard. While migrating, the
+// session is moved to its shard.
+func (s *Store) Touch(ctx context.Context, id string, expiry time.Time) error {
+	s.mu.RLock()
+	owner, previous := s.owners(id)
+	s.mu.RUnlock()
+	if len(previous) > 0 {
+		data, _, err := owner.Find(ctx, id)
+		if err != nil {
+			return err
+		} else if data == nil {
+			if err := move(ctx, id, owner, previous); err != nil {
+				return err
+			}
+		}
+	}
+	return storeutil.Touch(ctx, owner, id, expiry)
+}
+
+// List the sessions on every shard. While migrating, sessions that haven't
+// moved yet are listed by their previous shard. It returns
+// errors.ErrUnsupported if a shard doesn't implement sesh.Lister.
+func (s *Store) List(ctx context.Context, fn func(id string) error) error {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.shards))
+	for name := range s.shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	listers := make([]sesh.Lister, 0, len(names))
+	for _, name := range names {
+		lister, ok := s.shards[name].(sesh.Lister)
+		if !ok {
+			s.mu.RUnlock()
+			return errors.ErrUnsupported
+		}
+		listers = append(listers, lister)
+	}
+	s.mu.RUnlock()
+	for _, lister := range listers {
+		if err := lister.List(ctx, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package shardstore_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/filestore"
+	"github.com/matthewmueller/sesh/mockstore"
+	"github.com/matthewmueller/sesh/shardstore"
+	"github.com/matthewmueller/sesh/storetest"
+)
+
+func newShards(names ...string) map[string]sesh.Store {
+	shards := map[string]sesh.Store{}
+	for _, name := range names {
+		shards[name] = sesh.NewMemoryStore()
+	}
+	return shards
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t testing.TB) sesh.Store {
+		store, err := shardstore.New(newShards("a", "b", "c"))
+		is.New(t).NoErr(err)
+		return store
+	})
+}
+
+func TestNoShards(t *testing.T) {
+	is := is.New(t)
+	_, err := shardstore.New(nil)
+	is.Equal(err.Error(), "shardstore: at least one shard is required")
+}
+
+func TestDistribution(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	shards := newShards("a", "b", "c")
+	store, err := shardstore.New(shards)
+	is.NoErr(err)
+	for i := 0; i < 3000; i++ {
+		err := store.Upsert(ctx, "s"+strconv.Itoa(i), []byte("data"), time.Now().Add(time.Minute))
+		is.NoErr(err)
+	}
+	for name, shard := range shards {
+		n := shard.(*sesh.MemoryStore).Len()
+		if n < 700 || n > 1300 {
+			t.Fatalf("expected shard %q to have about 1000 sessions, got %d", name, n)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	is := is.New(t)
+	store, err := shardstore.New(newShards("a", "b", "c"))
+	is.NoErr(err)
+	before := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		id := "s" + strconv.Itoa(i)
+		before[id] = store.Shard(id)
+	}
+	is.NoErr(store.Add("d", sesh.NewMemoryStore()))
+	moved := 0
+	for id, shard := range before {
+		after := store.Shard(id)
+		if after == shard {
+			continue
+		}
+		// Sessions only move to the new shard
+		is.Equal(after, "d")
+		moved++
+	}
+	if moved < 150 || moved > 350 {
+		t.Fatalf("expected about 250 sessions to move, got %d", moved)
+	}
+	err = store.Add("d", sesh.NewMemoryStore())
+	is.Equal(err.Error(), `shardstore: shard "d" already exists`)
+}
+
+// movedID returns a session id that moves to shard d
+func movedID(t testing.TB, before, after *shardstore.Store) string {
+	for i := 0; i < 1000; i++ {
+		id := "s" + strconv.Itoa(i)
+		if before.Shard(id) != after.Shard(id) {
+			return id
+		}
+	}
+	t.Fatal("no session moved")
+	return ""
+}
+
+func TestMigration(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	shards := newShards("a", "b", "c")
+	store, err := shardstore.New(shards)
+	is.NoErr(err)
+	before, err := shardstore.New(shards)
+	is.NoErr(err)
+	d := sesh.NewMemoryStore()
+	is.NoErr(store.Add("d", d))
+	id := movedID(t, before, store)
+	old := shards[before.Shard(id)].(*sesh.MemoryStore)
+	// Write the session to its previous shard
+	err = old.Upsert(ctx, id, []byte("data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	// The session is read from its previous shard on a miss
+	data, _, err := store.Find(ctx, id)
+	is.NoErr(err)
+	is.Equal(string(data), "data")
+	// Writing the session moves it to the new shard
+	err = store.Upsert(ctx, id, []byte("new_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	is.Equal(old.Len(), 0)
+	is.Equal(d.Len(), 1)
+	data, _, err = store.Find(ctx, id)
+	is.NoErr(err)
+	is.Equal(string(data), "new_data")
+	// Deleting removes the session from both shards
+	err = old.Upsert(ctx, id, []byte("data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	is.NoErr(store.Delete(ctx, id))
+	is.Equal(old.Len(), 0)
+	is.Equal(d.Len(), 0)
+	// Once the migration is finished, previous shards aren't read
+	err = old.Upsert(ctx, id, []byte("data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	store.FinishMigration()
+	data, _, err = store.Find(ctx, id)
+	is.NoErr(err)
+	is.Equal(data, nil)
+}
+
+func TestMigrationTouch(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	shards := newShards("a", "b", "c")
+	store, err := shardstore.New(shards)
+	is.NoErr(err)
+	before, err := shardstore.New(shards)
+	is.NoErr(err)
+	d := sesh.NewMemoryStore()
+	is.NoErr(store.Add("d", d))
+	id := movedID(t, before, store)
+	old := shards[before.Shard(id)].(*sesh.MemoryStore)
+	err = old.Upsert(ctx, id, []byte("data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	newExpiry := time.Now().Add(time.Hour)
+	is.NoErr(store.Touch(ctx, id, newExpiry))
+	is.Equal(old.Len(), 0)
+	data, expiry, err := d.Find(ctx, id)
+	is.NoErr(err)
+	is.Equal(string(data), "data")
+	is.Equal(expiry.Unix(), newExpiry.Unix())
+}
+
+func TestMigrationVersioned(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	shards := newShards("a", "b", "c")
+	store, err := shardstore.New(shards)
+	is.NoErr(err)
+	before, err := shardstore.New(shards)
+	is.NoErr(err)
+	d := sesh.NewMemoryStore()
+	is.NoErr(store.Add("d", d))
+	id := movedID(t, before, store)
+	old := shards[before.Shard(id)].(*sesh.MemoryStore)
+	err = old.Upsert(ctx, id, []byte("data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	// The session is moved to its shard, so its version can be written
+	data, _, version, err := store.FindVersion(ctx, id)
+	is.NoErr(err)
+	is.Equal(string(data), "data")
+	is.Equal(version, int64(1))
+	is.Equal(old.Len(), 0)
+	is.Equal(d.Len(), 1)
+	err = store.UpsertIfVersion(ctx, id, []byte("new_data"), time.Now().Add(time.Minute), version)
+	is.NoErr(err)
+	// Sessions on every shard are listed
+	var ids []string
+	err = store.List(ctx, func(id string) error {
+		ids = append(ids, id)
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(ids, []string{id})
+}
+
+func TestMigrationDelete(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	shards := newShards("a", "b", "c")
+	before, err := shardstore.New(shards)
+	is.NoErr(err)
+	after, err := shardstore.New(shards)
+	is.NoErr(err)
+	is.NoErr(after.Add("d", sesh.NewMemoryStore()))
+	id := movedID(t, before, after)
+	old := shards[before.Shard(id)].(*sesh.MemoryStore)
+	err = old.Upsert(ctx, id, []byte("data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	// The session is deleted after it's been read from its previous shard, but
+	// before it's been moved to its shard
+	var store *shardstore.Store
+	mock := mockstore.New()
+	mock.MockDelete = old.Delete
+	mock.MockFind = func(ctx context.Context, id string) ([]byte, time.Time, error) {
+		data, expiry, err := old.Find(ctx, id)
+		if err != nil || data == nil {
+			return data, expiry, err
+		}
+		mock.MockFind = old.Find
+		if err := store.Delete(ctx, id); err != nil {
+			return nil, time.Time{}, err
+		}
+		return data, expiry, nil
+	}
+	shards[before.Shard(id)] = mock
+	store, err = shardstore.New(shards)
+	is.NoErr(err)
+	d := sesh.NewMemoryStore()
+	is.NoErr(store.Add("d", d))
+	data, _, _, err := store.FindVersion(ctx, id)
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.Equal(d.Len(), 0)
+	data, _, err = store.Find(ctx, id)
+	is.NoErr(err)
+	is.Equal(data, nil)
+}
+
+func TestUnsupported(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store, err := shardstore.New(map[string]sesh.Store{
+		"a": sesh.NewMemoryStore(),
+		"b": filestore.New(t.TempDir()),
+	})
+	is.NoErr(err)
+	err = store.List(ctx, func(id string) error { return nil })
+	is.True(errors.Is(err, errors.ErrUnsupported))
+	// Find an id on the unversioned shard
+	id := "s0"
+	for i := 1; store.Shard(id) != "b"; i++ {
+		id = "s" + strconv.Itoa(i)
+	}
+	_, _, _, err = store.FindVersion(ctx, id)
+	is.True(errors.Is(err, errors.ErrUnsupported))
+	err = store.UpsertIfVersion(ctx, id, []byte("data"), time.Now().Add(time.Minute), 0)
+	is.True(errors.Is(err, errors.ErrUnsupported))
+}
@@ -0,0 +1,50 @@
+package sesh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// sign the session id with the current secret. The signature is appended to
+// the session id, separated by a period.
+func (m *Manager[Data]) sign(id string) string {
+	if len(m.Secrets) == 0 {
+		return id
+	}
+	return id + "." + base64.RawURLEncoding.EncodeToString(m.mac(m.Secrets[0], id))
+}
+
+// verify the signed session id, returning the session id along with the index
+// of the secret that signed it.
+func (m *Manager[Data]) verify(value string) (id string, secret int, ok bool) {
+	if len(m.Secrets) == 0 {
+		return value, 0, true
+	}
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", 0, false
+	}
+	id = value[:i]
+	signature, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	for i, secret := range m.Secrets {
+		if hmac.Equal(signature, m.mac(secret, id)) {
+			return id, i, true
+		}
+	}
+	return "", 0, false
+}
+
+// mac computes the signature for the session id. The cookie name is included
+// so signed values can't be reused in other cookies.
+func (m *Manager[Data]) mac(secret []byte, id string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(m.Cookie.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(id))
+	return h.Sum(nil)
+}
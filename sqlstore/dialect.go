@@ -0,0 +1,141 @@
+package sqlstore
+
+// Dialect contains the SQL for a database. Queries are format strings where
+// %[1]s is replaced with the table name. The arguments each query expects are
+// listed alongside it.
+type Dialect struct {
+	Name string
+
+	// Schema creates the session table and its expiry index
+	Schema []string
+
+	// HasVersion counts the version columns in the table, so tables created
+	// before sessions were versioned can be migrated. It's the only query that
+	// isn't formatted with the table name. Args: table
+	HasVersion string
+
+	// AddVersion adds the version column to the table
+	AddVersion string
+
+	// Find selects the data, expiry and version of a session. Args: id
+	Find string
+
+	// Upsert inserts a session at version 1 or replaces it, incrementing the
+	// version. Args: id, data, expiry
+	Upsert string
+
+	// Insert inserts a session at version 1, doing nothing if the session
+	// exists. Args: id, data, expiry
+	Insert string
+
+	// DeleteExpired deletes the session if it's expired. Args: id, now
+	DeleteExpired string
+
+	// Update replaces a session that's at a version and hasn't expired,
+	// incrementing the version. Args: data, expiry, id, version, now
+	Update string
+
+	// Touch updates the expiry of a session. Args: expiry, id
+	Touch string
+
+	// Delete deletes a session. Args: id
+	Delete string
+
+	// Cleanup deletes a batch of expired sessions. Args: now, limit
+	Cleanup string
+
+	// Reset deletes every session
+	Reset string
+
+	// List selects a page of unexpired session ids after an id, ordered by id.
+	// Args: after, now, limit
+	List string
+
+	// UnixTime stores the expiry as seconds since the unix epoch, rather than as
+	// a timestamp
+	UnixTime bool
+}
+
+// SQLite stores sessions in SQLite 3.24 or later
+var SQLite = &Dialect{
+	Name: "sqlite",
+	Schema: []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+	id TEXT PRIMARY KEY,
+	data BLOB NOT NULL,
+	expiry INTEGER NOT NULL,
+	version INTEGER NOT NULL DEFAULT 1
+)`,
+		`CREATE INDEX IF NOT EXISTS %[1]s_expiry_idx ON %[1]s(expiry)`,
+	},
+	HasVersion:    `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = 'version'`,
+	AddVersion:    `ALTER TABLE %[1]s ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+	Find:          `SELECT data, expiry, version FROM %[1]s WHERE id = ?`,
+	Upsert:        `INSERT INTO %[1]s (id, data, expiry, version) VALUES (?, ?, ?, 1) ON CONFLICT(id) DO UPDATE SET data = excluded.data, expiry = excluded.expiry, version = %[1]s.version + 1`,
+	Insert:        `INSERT INTO %[1]s (id, data, expiry, version) VALUES (?, ?, ?, 1) ON CONFLICT(id) DO NOTHING`,
+	DeleteExpired: `DELETE FROM %[1]s WHERE id = ? AND expiry < ?`,
+	Update:        `UPDATE %[1]s SET data = ?, expiry = ?, version = version + 1 WHERE id = ? AND version = ? AND expiry >= ?`,
+	Touch:         `UPDATE %[1]s SET expiry = ? WHERE id = ?`,
+	Delete:        `DELETE FROM %[1]s WHERE id = ?`,
+	Cleanup:       `DELETE FROM %[1]s WHERE id IN (SELECT id FROM %[1]s WHERE expiry < ? LIMIT ?)`,
+	Reset:         `DELETE FROM %[1]s`,
+	List:          `SELECT id FROM %[1]s WHERE id > ? AND expiry >= ? ORDER BY id LIMIT ?`,
+	UnixTime:      true,
+}
+
+// Postgres stores sessions in PostgreSQL 9.5 or later
+var Postgres = &Dialect{
+	Name: "postgres",
+	Schema: []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+	id TEXT PRIMARY KEY,
+	data BYTEA NOT NULL,
+	expiry TIMESTAMPTZ NOT NULL,
+	version BIGINT NOT NULL DEFAULT 1
+)`,
+		`CREATE INDEX IF NOT EXISTS %[1]s_expiry_idx ON %[1]s(expiry)`,
+	},
+	// Unquoted table names are folded to lower case
+	HasVersion:    `SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = lower($1) AND column_name = 'version'`,
+	AddVersion:    `ALTER TABLE %[1]s ADD COLUMN version BIGINT NOT NULL DEFAULT 1`,
+	Find:          `SELECT data, expiry, version FROM %[1]s WHERE id = $1`,
+	Upsert:        `INSERT INTO %[1]s (id, data, expiry, version) VALUES ($1, $2, $3, 1) ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, version = %[1]s.version + 1`,
+	Insert:        `INSERT INTO %[1]s (id, data, expiry, version) VALUES ($1, $2, $3, 1) ON CONFLICT (id) DO NOTHING`,
+	DeleteExpired: `DELETE FROM %[1]s WHERE id = $1 AND expiry < $2`,
+	Update:        `UPDATE %[1]s SET data = $1, expiry = $2, version = version + 1 WHERE id = $3 AND version = $4 AND expiry >= $5`,
+	Touch:         `UPDATE %[1]s SET expiry = $1 WHERE id = $2`,
+	Delete:        `DELETE FROM %[1]s WHERE id = $1`,
+	Cleanup:       `DELETE FROM %[1]s WHERE id IN (SELECT id FROM %[1]s WHERE expiry < $1 LIMIT $2)`,
+	Reset:         `DELETE FROM %[1]s`,
+	List:          `SELECT id FROM %[1]s WHERE id > $1 AND expiry >= $2 ORDER BY id LIMIT $3`,
+}
+
+// MySQL stores sessions in MySQL 5.7 or later. Insert uses INSERT IGNORE, so
+// duplicates aren't counted as affected rows, even with clientFoundRows. Ids
+// are stored as VARBINARY, so they're compared byte for byte rather than with
+// a case-insensitive collation.
+var MySQL = &Dialect{
+	Name: "mysql",
+	Schema: []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+	id VARBINARY(255) NOT NULL PRIMARY KEY,
+	data LONGBLOB NOT NULL,
+	expiry BIGINT NOT NULL,
+	version BIGINT NOT NULL DEFAULT 1,
+	INDEX %[1]s_expiry_idx (expiry)
+)`,
+	},
+	HasVersion:    `SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = 'version'`,
+	AddVersion:    `ALTER TABLE %[1]s ADD COLUMN version BIGINT NOT NULL DEFAULT 1`,
+	Find:          `SELECT data, expiry, version FROM %[1]s WHERE id = ?`,
+	Upsert:        `INSERT INTO %[1]s (id, data, expiry, version) VALUES (?, ?, ?, 1) ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry), version = version + 1`,
+	Insert:        `INSERT IGNORE INTO %[1]s (id, data, expiry, version) VALUES (?, ?, ?, 1)`,
+	DeleteExpired: `DELETE FROM %[1]s WHERE id = ? AND expiry < ?`,
+	Update:        `UPDATE %[1]s SET data = ?, expiry = ?, version = version + 1 WHERE id = ? AND version = ? AND expiry >= ?`,
+	Touch:         `UPDATE %[1]s SET expiry = ? WHERE id = ?`,
+	Delete:        `DELETE FROM %[1]s WHERE id = ?`,
+	Cleanup:       `DELETE FROM %[1]s WHERE expiry < ? LIMIT ?`,
+	Reset:         `DELETE FROM %[1]s`,
+	List:          `SELECT id FROM %[1]s WHERE id > ? AND expiry >= ? ORDER BY id LIMIT ?`,
+	UnixTime:      true,
+}
@@ -0,0 +1,239 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/internal/storeutil"
+)
+
+// New creates a session store for a database/sql database. The dialect must
+// match the database's driver. Call Migrate to create the session table.
+func New(db *sql.DB, dialect *Dialect) *Store {
+	return &Store{
+		db:        db,
+		dialect:   dialect,
+		Table:     "sessions",
+		Now:       time.Now,
+		BatchSize: 1000,
+	}
+}
+
+type Store struct {
+	db      *sql.DB
+	dialect *Dialect
+	Table   string
+
+	// Used for testing
+	Now func() time.Time
+
+	// BatchSize is the maximum number of expired sessions removed per statement
+	// during cleanup, or sessions selected per query while listing. Smaller
+	// batches hold the write lock for less time.
+	BatchSize int
+}
+
+var _ sesh.Store = (*Store)(nil)
+var _ sesh.Toucher = (*Store)(nil)
+var _ sesh.VersionedStore = (*Store)(nil)
+var _ sesh.Lister = (*Store)(nil)
+
+var errBatchSize = errors.New("sqlstore: BatchSize must be greater than 0")
+
+// query formats the dialect's query with the table name
+func (s *Store) query(query string) string {
+	return fmt.Sprintf(query, s.Table)
+}
+
+// expiry converts the time into the dialect's column type
+func (s *Store) expiry(t time.Time) any {
+	if s.dialect.UnixTime {
+		return t.Unix()
+	}
+	return t
+}
+
+// Migrate creates the session table, adding the version column to tables
+// created before it existed.
+func (s *Store) Migrate(ctx context.Context) error {
+	for _, statement := range s.dialect.Schema {
+		if _, err := s.db.ExecContext(ctx, s.query(statement)); err != nil {
+			return err
+		}
+	}
+	var columns int
+	if err := s.db.QueryRowContext(ctx, s.dialect.HasVersion, s.Table).Scan(&columns); err != nil {
+		return err
+	}
+	if columns > 0 {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, s.query(s.dialect.AddVersion))
+	return err
+}
+
+// Find returns the data for a session id from the store. If the session is not
+// found or expired, the data will be nil and the time will be zero, but there
+// will be no error.
+func (s *Store) Find(ctx context.Context, id string) (data []byte, expiry time.Time, err error) {
+	data, expiry, _, err = s.FindVersion(ctx, id)
+	return data, expiry, err
+}
+
+// FindVersion is like Find, but also returns the version of the session.
+func (s *Store) FindVersion(ctx context.Context, id string) (data []byte, expiry time.Time, version int64, err error) {
+	row := s.db.QueryRowContext(ctx, s.query(s.dialect.Find), id)
+	if s.dialect.UnixTime {
+		var unixTimeSec int64
+		err = row.Scan(&data, &unixTimeSec, &version)
+		expiry = time.Unix(unixTimeSec, 0)
+	} else {
+		err = row.Scan(&data, &expiry, &version)
+	}
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, time.Time{}, 0, err
+		}
+		// No session found
+		return nil, time.Time{}, 0, nil
+	}
+	// Check if the session has expired
+	if expiry.Before(s.Now()) {
+		return nil, time.Time{}, 0, nil
+	}
+	return data, expiry, version, nil
+}
+
+func (s *Store) Upsert(ctx context.Context, id string, data []byte, expiry time.Time) error {
+	_, err := s.db.ExecContext(ctx, s.query(s.dialect.Upsert), id, data, s.expiry(expiry))
+	return err
+}
+
+// UpsertIfVersion is like Upsert, but returns sesh.ErrConflict if the session
+// has been changed since version.
+func (s *Store) UpsertIfVersion(ctx context.Context, id string, data []byte, expiry time.Time, version int64) error {
+	now := s.expiry(s.Now())
+	var result sql.Result
+	var err error
+	if version == 0 {
+		// Insert new sessions, replacing expired ones
+		if _, err := s.db.ExecContext(ctx, s.query(s.dialect.DeleteExpired), id, now); err != nil {
+			return err
+		}
+		result, err = s.db.ExecContext(ctx, s.query(s.dialect.Insert), id, data, s.expiry(expiry))
+	} else {
+		// Update existing sessions that haven't changed
+		result, err = s.db.ExecContext(ctx, s.query(s.dialect.Update), data, s.expiry(expiry), id, version, now)
+	}
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sesh.ErrConflict
+	}
+	return nil
+}
+
+// Touch updates the expiry of a session without rewriting its data.
+func (s *Store) Touch(ctx context.Context, id string, expiry time.Time) error {
+	_, err := s.db.ExecContext(ctx, s.query(s.dialect.Touch), s.expiry(expiry), id)
+	return err
+}
+
+func (s *Store) Delete(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, s.query(s.dialect.Delete), id)
+	return err
+}
+
+// Cleanup removes expired sessions from the store.
+func (s *Store) Cleanup(ctx context.Context) error {
+	_, err := s.cleanup(ctx)
+	return err
+}
+
+// cleanup removes expired sessions in batches, returning the number of sessions
+// removed
+func (s *Store) cleanup(ctx context.Context) (removed int64, err error) {
+	if s.BatchSize <= 0 {
+		return 0, errBatchSize
+	}
+	now := s.expiry(s.Now())
+	for {
+		result, err := s.db.ExecContext(ctx, s.query(s.dialect.Cleanup), now, s.BatchSize)
+		if err != nil {
+			return removed, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+		if n < int64(s.BatchSize) {
+			return removed, nil
+		}
+	}
+}
+
+// StartCleanup removes expired sessions every interval in a background
+// goroutine until the context is cancelled. After each cleanup, report is
+// called with the number of sessions removed and any error. Report may be nil.
+// The returned channel is closed once the goroutine has stopped.
+func (s *Store) StartCleanup(ctx context.Context, interval time.Duration, report func(removed int64, err error)) <-chan struct{} {
+	return storeutil.StartCleanup(ctx, interval, s.cleanup, report)
+}
+
+// List calls fn with the id of every session that hasn't expired. Sessions are
+// listed in pages of BatchSize, so fn can use the database.
+func (s *Store) List(ctx context.Context, fn func(id string) error) error {
+	if s.BatchSize <= 0 {
+		return errBatchSize
+	}
+	now := s.expiry(s.Now())
+	after := ""
+	for {
+		ids, err := s.list(ctx, after, now)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := fn(id); err != nil {
+				return err
+			}
+		}
+		if len(ids) < s.BatchSize {
+			return nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+// list a page of session ids after an id
+func (s *Store) list(ctx context.Context, after string, now any) (ids []string, err error) {
+	rows, err := s.db.QueryContext(ctx, s.query(s.dialect.List), after, now, s.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Reset removes all sessions from the store.
+func (s *Store) Reset(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, s.query(s.dialect.Reset))
+	return err
+}
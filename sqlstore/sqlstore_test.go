@@ -0,0 +1,196 @@
+package sqlstore_test
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/diff"
+	"github.com/matthewmueller/sesh"
+	"github.com/matthewmueller/sesh/sqlstore"
+	"github.com/matthewmueller/sesh/storetest"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+var dialects = []*sqlstore.Dialect{
+	sqlstore.SQLite,
+	sqlstore.Postgres,
+	sqlstore.MySQL,
+}
+
+func open(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLite(t *testing.T) {
+	storetest.Run(t, func(t testing.TB) sesh.Store {
+		store := sqlstore.New(open(t), sqlstore.SQLite)
+		is.New(t).NoErr(store.Migrate(context.Background()))
+		return store
+	})
+}
+
+func TestMigrateTwice(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := sqlstore.New(open(t), sqlstore.SQLite)
+	store.Table = "user_sessions"
+	is.NoErr(store.Migrate(ctx))
+	is.NoErr(store.Upsert(ctx, "session_token", []byte("data"), time.Now().Add(time.Minute)))
+	is.NoErr(store.Migrate(ctx))
+	data, _, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "data")
+}
+
+// render the dialect's queries for the golden file
+func render(dialect *sqlstore.Dialect) string {
+	queries := []struct {
+		name  string
+		query string
+	}{
+		{"AddVersion", dialect.AddVersion},
+		{"Find", dialect.Find},
+		{"Upsert", dialect.Upsert},
+		{"Insert", dialect.Insert},
+		{"DeleteExpired", dialect.DeleteExpired},
+		{"Update", dialect.Update},
+		{"Touch", dialect.Touch},
+		{"Delete", dialect.Delete},
+		{"Cleanup", dialect.Cleanup},
+		{"Reset", dialect.Reset},
+		{"List", dialect.List},
+	}
+	out := new(strings.Builder)
+	for i, statement := range dialect.Schema {
+		fmt.Fprintf(out, "-- Schema %d\n%s;\n\n", i+1, fmt.Sprintf(statement, "sessions"))
+	}
+	// HasVersion takes the table as an argument
+	fmt.Fprintf(out, "-- HasVersion\n%s;\n\n", dialect.HasVersion)
+	for _, q := range queries {
+		fmt.Fprintf(out, "-- %s\n%s;\n\n", q.name, fmt.Sprintf(q.query, "sessions"))
+	}
+	return out.String()
+}
+
+func TestGolden(t *testing.T) {
+	for _, dialect := range dialects {
+		t.Run(dialect.Name, func(t *testing.T) {
+			path := filepath.Join("testdata", dialect.Name+".sql")
+			actual := render(dialect)
+			if *update {
+				if err := os.WriteFile(path, []byte(actual), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expect, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diff.TestString(t, actual, string(expect))
+		})
+	}
+}
+
+var numbered = regexp.MustCompile(`\$(\d+)`)
+
+// countArgs returns the number of arguments a query expects
+func countArgs(t testing.TB, dialect *sqlstore.Dialect, query string) int {
+	if dialect == sqlstore.Postgres {
+		if strings.Contains(query, "?") {
+			t.Fatalf("sqlstore: unexpected ? placeholder in %q", query)
+		}
+		max := 0
+		for _, match := range numbered.FindAllStringSubmatch(query, -1) {
+			n, err := strconv.Atoi(match[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n > max {
+				max = n
+			}
+		}
+		return max
+	}
+	if numbered.MatchString(query) {
+		t.Fatalf("sqlstore: unexpected $ placeholder in %q", query)
+	}
+	return strings.Count(query, "?")
+}
+
+func TestPlaceholders(t *testing.T) {
+	for _, dialect := range dialects {
+		t.Run(dialect.Name, func(t *testing.T) {
+			is := is.New(t)
+			for _, statement := range dialect.Schema {
+				is.Equal(countArgs(t, dialect, statement), 0)
+			}
+			is.Equal(countArgs(t, dialect, dialect.HasVersion), 1)
+			is.Equal(countArgs(t, dialect, dialect.AddVersion), 0)
+			is.Equal(countArgs(t, dialect, dialect.Find), 1)
+			is.Equal(countArgs(t, dialect, dialect.Upsert), 3)
+			is.Equal(countArgs(t, dialect, dialect.Insert), 3)
+			is.Equal(countArgs(t, dialect, dialect.DeleteExpired), 2)
+			is.Equal(countArgs(t, dialect, dialect.Update), 5)
+			is.Equal(countArgs(t, dialect, dialect.Touch), 2)
+			is.Equal(countArgs(t, dialect, dialect.Delete), 1)
+			is.Equal(countArgs(t, dialect, dialect.Cleanup), 2)
+			is.Equal(countArgs(t, dialect, dialect.Reset), 0)
+			is.Equal(countArgs(t, dialect, dialect.List), 3)
+		})
+	}
+}
+
+func TestListPages(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := sqlstore.New(open(t), sqlstore.SQLite)
+	store.BatchSize = 3
+	is.NoErr(store.Migrate(ctx))
+	for i := 0; i < 10; i++ {
+		err := store.Upsert(ctx, "s"+strconv.Itoa(i), []byte("data"), time.Now().Add(time.Minute))
+		is.NoErr(err)
+	}
+	var ids []string
+	err := store.List(ctx, func(id string) error {
+		ids = append(ids, id)
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(len(ids), 10)
+	is.Equal(ids[0], "s0")
+	is.Equal(ids[9], "s9")
+}
+
+func TestInvalidBatchSize(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	store := sqlstore.New(open(t), sqlstore.SQLite)
+	is.NoErr(store.Migrate(ctx))
+	is.NoErr(store.Upsert(ctx, "session_token", []byte("data"), time.Now().Add(time.Minute)))
+	for _, size := range []int{0, -1} {
+		store.BatchSize = size
+		err := store.Cleanup(ctx)
+		is.Equal(err.Error(), "sqlstore: BatchSize must be greater than 0")
+		err = store.List(ctx, func(id string) error { return nil })
+		is.Equal(err.Error(), "sqlstore: BatchSize must be greater than 0")
+	}
+}
@@ -0,0 +1,45 @@
+-- Schema 1
+CREATE TABLE IF NOT EXISTS sessions (
+	id VARBINARY(255) NOT NULL PRIMARY KEY,
+	data LONGBLOB NOT NULL,
+	expiry BIGINT NOT NULL,
+	version BIGINT NOT NULL DEFAULT 1,
+	INDEX sessions_expiry_idx (expiry)
+);
+
+-- HasVersion
+SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = 'version';
+
+-- AddVersion
+ALTER TABLE sessions ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+
+-- Find
+SELECT data, expiry, version FROM sessions WHERE id = ?;
+
+-- Upsert
+INSERT INTO sessions (id, data, expiry, version) VALUES (?, ?, ?, 1) ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry), version = version + 1;
+
+-- Insert
+INSERT IGNORE INTO sessions (id, data, expiry, version) VALUES (?, ?, ?, 1);
+
+-- DeleteExpired
+DELETE FROM sessions WHERE id = ? AND expiry < ?;
+
+-- Update
+UPDATE sessions SET data = ?, expiry = ?, version = version + 1 WHERE id = ? AND version = ? AND expiry >= ?;
+
+-- Touch
+UPDATE sessions SET expiry = ? WHERE id = ?;
+
+-- Delete
+DELETE FROM sessions WHERE id = ?;
+
+-- Cleanup
+DELETE FROM sessions WHERE expiry < ? LIMIT ?;
+
+-- Reset
+DELETE FROM sessions;
+
+-- List
+SELECT id FROM sessions WHERE id > ? AND expiry >= ? ORDER BY id LIMIT ?;
+
@@ -0,0 +1,47 @@
+-- Schema 1
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	data BYTEA NOT NULL,
+	expiry TIMESTAMPTZ NOT NULL,
+	version BIGINT NOT NULL DEFAULT 1
+);
+
+-- Schema 2
+CREATE INDEX IF NOT EXISTS sessions_expiry_idx ON sessions(expiry);
+
+-- HasVersion
+SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = lower($1) AND column_name = 'version';
+
+-- AddVersion
+ALTER TABLE sessions ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+
+-- Find
+SELECT data, expiry, version FROM sessions WHERE id = $1;
+
+-- Upsert
+INSERT INTO sessions (id, data, expiry, version) VALUES ($1, $2, $3, 1) ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, version = sessions.version + 1;
+
+-- Insert
+INSERT INTO sessions (id, data, expiry, version) VALUES ($1, $2, $3, 1) ON CONFLICT (id) DO NOTHING;
+
+-- DeleteExpired
+DELETE FROM sessions WHERE id = $1 AND expiry < $2;
+
+-- Update
+UPDATE sessions SET data = $1, expiry = $2, version = version + 1 WHERE id = $3 AND version = $4 AND expiry >= $5;
+
+-- Touch
+UPDATE sessions SET expiry = $1 WHERE id = $2;
+
+-- Delete
+DELETE FROM sessions WHERE id = $1;
+
+-- Cleanup
+DELETE FROM sessions WHERE id IN (SELECT id FROM sessions WHERE expiry < $1 LIMIT $2);
+
+-- Reset
+DELETE FROM sessions;
+
+-- List
+SELECT id FROM sessions WHERE id > $1 AND expiry >= $2 ORDER BY id LIMIT $3;
+
@@ -0,0 +1,47 @@
+-- Schema 1
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	data BLOB NOT NULL,
+	expiry INTEGER NOT NULL,
+	version INTEGER NOT NULL DEFAULT 1
+);
+
+-- Schema 2
+CREATE INDEX IF NOT EXISTS sessions_expiry_idx ON sessions(expiry);
+
+-- HasVersion
+SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = 'version';
+
+-- AddVersion
+ALTER TABLE sessions ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+
+-- Find
+SELECT data, expiry, version FROM sessions WHERE id = ?;
+
+-- Upsert
+INSERT INTO sessions (id, data, expiry, version) VALUES (?, ?, ?, 1) ON CONFLICT(id) DO UPDATE SET data = excluded.data, expiry = excluded.expiry, version = sessions.version + 1;
+
+-- Insert
+INSERT INTO sessions (id, data, expiry, version) VALUES (?, ?, ?, 1) ON CONFLICT(id) DO NOTHING;
+
+-- DeleteExpired
+DELETE FROM sessions WHERE id = ? AND expiry < ?;
+
+-- Update
+UPDATE sessions SET data = ?, expiry = ?, version = version + 1 WHERE id = ? AND version = ? AND expiry >= ?;
+
+-- Touch
+UPDATE sessions SET expiry = ? WHERE id = ?;
+
+-- Delete
+DELETE FROM sessions WHERE id = ?;
+
+-- Cleanup
+DELETE FROM sessions WHERE id IN (SELECT id FROM sessions WHERE expiry < ? LIMIT ?);
+
+-- Reset
+DELETE FROM sessions;
+
+-- List
+SELECT id FROM sessions WHERE id > ? AND expiry >= ? ORDER BY id LIMIT ?;
+
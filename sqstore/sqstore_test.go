@@ -3,6 +3,7 @@ package sqstore_test
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"strconv"
@@ -10,7 +11,9 @@ import (
 	"time"
 
 	"github.com/matryer/is"
+	"github.com/matthewmueller/sesh"
 	"github.com/matthewmueller/sesh/sqstore"
+	"github.com/matthewmueller/sesh/storetest"
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/sync/errgroup"
 )
@@ -186,3 +189,166 @@ func TestParallel(t *testing.T) {
 	}
 	is.NoErr(eg.Wait())
 }
+
+func TestTouch(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "test.db"))
+	is.NoErr(err)
+	defer db.Close()
+	store := sqstore.New(db)
+	is.NoErr(store.Migrate(ctx))
+	inputData := []byte("encoded_data")
+	inputExpiry := time.Now().Add(time.Minute)
+	err = store.Upsert(ctx, "session_token", inputData, inputExpiry)
+	is.NoErr(err)
+	newExpiry := time.Now().Add(time.Hour)
+	err = store.Touch(ctx, "session_token", newExpiry)
+	is.NoErr(err)
+	actualData, actualExpiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(actualData), string(inputData))
+	is.Equal(actualExpiry.Unix(), newExpiry.Unix())
+	// Touching a missing session is a no-op
+	err = store.Touch(ctx, "missing", newExpiry)
+	is.NoErr(err)
+	data, expiry, err := store.Find(ctx, "missing")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.True(expiry.IsZero())
+}
+
+func TestUpsertIfVersion(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "test.db"))
+	is.NoErr(err)
+	defer db.Close()
+	store := sqstore.New(db)
+	is.NoErr(store.Migrate(ctx))
+	inputExpiry := time.Now().Add(time.Minute)
+	data, expiry, version, err := store.FindVersion(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.True(expiry.IsZero())
+	is.Equal(version, int64(0))
+	// Insert a new session
+	err = store.UpsertIfVersion(ctx, "session_token", []byte("v1"), inputExpiry, 0)
+	is.NoErr(err)
+	data, _, version, err = store.FindVersion(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "v1")
+	is.Equal(version, int64(1))
+	// The session already exists
+	err = store.UpsertIfVersion(ctx, "session_token", []byte("v1"), inputExpiry, 0)
+	is.True(errors.Is(err, sesh.ErrConflict))
+	// Update the session
+	err = store.UpsertIfVersion(ctx, "session_token", []byte("v2"), inputExpiry, 1)
+	is.NoErr(err)
+	// Stale version
+	err = store.UpsertIfVersion(ctx, "session_token", []byte("v3"), inputExpiry, 1)
+	is.True(errors.Is(err, sesh.ErrConflict))
+	// Plain upserts also bump the version
+	err = store.Upsert(ctx, "session_token", []byte("v3"), inputExpiry)
+	is.NoErr(err)
+	data, _, version, err = store.FindVersion(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "v3")
+	is.Equal(version, int64(3))
+	// Expired sessions can be replaced
+	err = store.Upsert(ctx, "expired_token", []byte("old"), time.Now().Add(-time.Minute))
+	is.NoErr(err)
+	err = store.UpsertIfVersion(ctx, "expired_token", []byte("new"), inputExpiry, 0)
+	is.NoErr(err)
+	data, _, version, err = store.FindVersion(ctx, "expired_token")
+	is.NoErr(err)
+	is.Equal(string(data), "new")
+	is.Equal(version, int64(1))
+}
+
+func TestMigrateVersion(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "test.db"))
+	is.NoErr(err)
+	defer db.Close()
+	// Table created before versions were added
+	_, err = db.ExecContext(ctx, `CREATE TABLE sessions (id TEXT PRIMARY KEY, data BLOB NOT NULL, expiry INTEGER NOT NULL)`)
+	is.NoErr(err)
+	_, err = db.ExecContext(ctx, `INSERT INTO sessions (id, data, expiry) VALUES ('session_token', 'encoded_data', ?)`, time.Now().Add(time.Minute).Unix())
+	is.NoErr(err)
+	store := sqstore.New(db)
+	is.NoErr(store.Migrate(ctx))
+	is.NoErr(store.Migrate(ctx))
+	data, _, version, err := store.FindVersion(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	is.Equal(version, int64(1))
+	err = store.UpsertIfVersion(ctx, "session_token", []byte("new_data"), time.Now().Add(time.Minute), 1)
+	is.NoErr(err)
+}
+
+func TestCleanupBatches(t *testing.T) {
+	ctx := context.Background()
+	is := is.New(t)
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "test.db"))
+	is.NoErr(err)
+	defer db.Close()
+	store := sqstore.New(db)
+	store.BatchSize = 3
+	is.NoErr(store.Migrate(ctx))
+	for i := 0; i < 10; i++ {
+		err = store.Upsert(ctx, "expired"+strconv.Itoa(i), []byte("data"), time.Now().Add(-time.Minute))
+		is.NoErr(err)
+	}
+	err = store.Upsert(ctx, "session_token", []byte("data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	is.NoErr(store.Cleanup(ctx))
+	var count int
+	is.NoErr(db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sessions`).Scan(&count))
+	is.Equal(count, 1)
+}
+
+func TestStartCleanup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	is := is.New(t)
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "test.db"))
+	is.NoErr(err)
+	defer db.Close()
+	store := sqstore.New(db)
+	store.BatchSize = 3
+	is.NoErr(store.Migrate(ctx))
+	for i := 0; i < 10; i++ {
+		err = store.Upsert(ctx, "expired"+strconv.Itoa(i), []byte("data"), time.Now().Add(-time.Minute))
+		is.NoErr(err)
+	}
+	reports := make(chan int64, 100)
+	done := store.StartCleanup(ctx, time.Millisecond, func(removed int64, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		reports <- removed
+	})
+	is.Equal(<-reports, int64(10))
+	is.Equal(<-reports, int64(0))
+	cancel()
+	<-done
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t testing.TB) sesh.Store {
+		is := is.New(t)
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+		is.NoErr(err)
+		t.Cleanup(func() { db.Close() })
+		store := sqstore.New(db)
+		is.NoErr(store.Migrate(context.Background()))
+		return store
+	})
+}
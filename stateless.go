@@ -0,0 +1,221 @@
+package sesh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// chunkSize is the maximum length of a cookie value before the session is
+	// split across multiple cookies. Browsers limit cookies to about 4KB
+	// including the name and attributes.
+	chunkSize = 3800
+
+	// maxChunks is the maximum number of cookies a session can be split across
+	maxChunks = 10
+)
+
+var (
+	errNoSecrets = errors.New("sesh: stateless sessions require at least one secret")
+	errTooLarge  = errors.New("sesh: session is too large to store in cookies")
+)
+
+// chunkName returns the cookie name for the nth chunk of the session
+func (m *Manager[Data]) chunkName(n int) string {
+	if n == 0 {
+		return m.Cookie.Name
+	}
+	return m.Cookie.Name + "." + strconv.Itoa(n)
+}
+
+// readStateless reads the session from the request cookies
+func (m *Manager[Data]) readStateless(r Request) (*Session[*Data], error) {
+	if len(m.Secrets) == 0 {
+		return nil, errNoSecrets
+	}
+	value := ""
+	chunks := 0
+	for ; chunks < maxChunks; chunks++ {
+		cookie, err := r.Cookie(m.chunkName(chunks))
+		if err != nil {
+			if !errors.Is(err, http.ErrNoCookie) {
+				return nil, err
+			}
+			break
+		}
+		value += cookie.Value
+	}
+	session, err := m.unseal(value)
+	if err != nil {
+		return nil, err
+	}
+	// Keep track of the cookies so they can be replaced or expired later
+	session.chunks = chunks
+	return session, nil
+}
+
+// unseal the session from the cookie value. Cookies that are missing, expired
+// or tampered with start a new session.
+func (m *Manager[Data]) unseal(value string) (*Session[*Data], error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || value == "" {
+		return m.newSession(), nil
+	}
+	payload, secret, ok := m.open(sealed)
+	if !ok {
+		return m.newSession(), nil
+	}
+	size, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < size {
+		return m.newSession(), nil
+	}
+	id, payload := string(payload[n:n+int(size)]), payload[n+int(size):]
+	unixNano, n := binary.Varint(payload)
+	if n <= 0 {
+		return m.newSession(), nil
+	}
+	expiry, raw := time.Unix(0, unixNano), payload[n:]
+	if expiry.Before(m.Now()) {
+		return m.newSession(), nil
+	}
+	rec, err := decodeRecord(raw)
+	if err != nil {
+		return m.invalidSession(id, err)
+	}
+	// Session has outlived its lifetime
+	if m.Lifetime > 0 && !rec.Created.IsZero() && rec.Created.Add(m.Lifetime).Before(m.Now()) {
+		return m.newSession(), nil
+	}
+	data, err := m.decode(rec)
+	if err != nil {
+		return m.invalidSession(id, err)
+	}
+	return &Session[*Data]{
+		ID:        id,
+		Data:      data,
+		Expiry:    expiry,
+		Created:   rec.Created,
+		transient: rec.Transient,
+		stored:    &snapshot{id, raw, expiry},
+		resign:    secret > 0,
+	}, nil
+}
+
+// writeStateless writes the session to the response cookies
+func (m *Manager[Data]) writeStateless(w ResponseWriter, session *Session[*Data]) error {
+	if len(m.Secrets) == 0 {
+		return errNoSecrets
+	}
+	if session.destroyed {
+		m.expireChunks(w, 0, max(session.chunks, 1))
+		session.chunks = 0
+		return nil
+	}
+	if err := m.prepareSession(session); err != nil {
+		return err
+	}
+	raw, err := m.encode(session)
+	if err != nil {
+		return err
+	}
+	// The browser already has up-to-date cookies
+	if session.sameData(raw) && session.stored.expiry.Equal(session.Expiry) && !session.resign {
+		return nil
+	}
+	value, err := m.seal(session.ID, session.Expiry, raw)
+	if err != nil {
+		return err
+	}
+	chunks := (len(value) + chunkSize - 1) / chunkSize
+	if chunks > maxChunks {
+		return errTooLarge
+	}
+	expiry := session.Expiry
+	// Leave out the expiry for browser session cookies
+	if session.transient {
+		expiry = time.Time{}
+	}
+	now := m.Now()
+	for i := 0; i < chunks; i++ {
+		cookie := m.Cookie.cookie(value[i*chunkSize:min((i+1)*chunkSize, len(value))], expiry, now)
+		cookie.Name = m.chunkName(i)
+		if v := cookie.String(); v != "" {
+			w.Header().Add("Set-Cookie", v)
+		}
+	}
+	// Expire leftover cookies from a larger session
+	m.expireChunks(w, chunks, session.chunks)
+	session.chunks = chunks
+	session.previous = ""
+	session.resign = false
+	session.stored = &snapshot{session.ID, raw, session.Expiry}
+	return nil
+}
+
+// expireChunks expires the session cookies from start up until end
+func (m *Manager[Data]) expireChunks(w ResponseWriter, start, end int) {
+	for i := start; i < end; i++ {
+		cookie := m.Cookie.expired()
+		cookie.Name = m.chunkName(i)
+		if v := cookie.String(); v != "" {
+			w.Header().Add("Set-Cookie", v)
+		}
+	}
+}
+
+// seal encrypts and authenticates the session with the current secret
+func (m *Manager[Data]) seal(id string, expiry time.Time, raw []byte) (string, error) {
+	aead, err := m.aead(m.Secrets[0])
+	if err != nil {
+		return "", err
+	}
+	payload := binary.AppendUvarint(nil, uint64(len(id)))
+	payload = append(payload, id...)
+	payload = binary.AppendVarint(payload, expiry.UnixNano())
+	payload = append(payload, raw...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, payload, []byte(m.Cookie.Name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts the session with any of the secrets, returning the index of
+// the secret that sealed it
+func (m *Manager[Data]) open(sealed []byte) (payload []byte, secret int, ok bool) {
+	for i, secret := range m.Secrets {
+		aead, err := m.aead(secret)
+		if err != nil || len(sealed) < aead.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		payload, err := aead.Open(nil, nonce, ciphertext, []byte(m.Cookie.Name))
+		if err != nil {
+			continue
+		}
+		return payload, i, true
+	}
+	return nil, 0, false
+}
+
+// aead derives an AES-256-GCM cipher from the secret. The key is derived
+// separately from the key used to sign session ids.
+func (m *Manager[Data]) aead(secret []byte) (cipher.AEAD, error) {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("sesh stateless session"))
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,197 @@
+package sesh_test
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/sesh"
+)
+
+// serve the request with the cookies from the jar, returning the response
+func serve(jar *cookiejar.Jar, h http.Handler, r *http.Request) *http.Response {
+	for _, cookie := range jar.Cookies(r.URL) {
+		r.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	w := rec.Result()
+	jar.SetCookies(r.URL, w.Cookies())
+	return w
+}
+
+func statelessSessions() *sesh.Manager[struct{ Visits int }] {
+	sessions := sesh.New[struct{ Visits int }]()
+	sessions.Now = futureDate
+	sessions.Store = nil
+	sessions.Stateless = true
+	sessions.Secrets = [][]byte{[]byte("secret")}
+	return sessions
+}
+
+func TestStateless(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	sessions := statelessSessions()
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		if r.Method == http.MethodPost {
+			session.Visits++
+		}
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	for i := 1; i <= 3; i++ {
+		res := serve(jar, handler, httptest.NewRequest(http.MethodPost, "http://example.com/", nil))
+		body := new(strings.Builder)
+		is.NoErr(res.Write(body))
+		is.True(strings.HasSuffix(body.String(), strconv.Itoa(i)))
+		cookies := res.Cookies()
+		is.Equal(len(cookies), 1)
+		is.Equal(cookies[0].Name, "sid")
+		is.Equal(cookies[0].Expires, futureDate().Add(sessions.Cookie.ExpireIn))
+		is.True(cookies[0].HttpOnly)
+	}
+	// Unchanged sessions don't set the cookie again
+	res := serve(jar, handler, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	is.Equal(len(res.Cookies()), 0)
+	// Sessions can't be read with a different secret
+	sessions.Secrets = [][]byte{[]byte("other")}
+	res = serve(jar, handler, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	body := new(strings.Builder)
+	is.NoErr(res.Write(body))
+	is.True(strings.HasSuffix(body.String(), "\r\n\r\n0"))
+}
+
+func TestStatelessTampered(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	sessions := statelessSessions()
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	res := serve(jar, handler, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	value := res.Cookies()[0].Value
+	flipped := "A"
+	if value[10] == 'A' {
+		flipped = "B"
+	}
+	for _, tampered := range []string{
+		"",
+		"invalid",
+		value[:len(value)-2],
+		value[:10] + flipped + value[11:],
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.AddCookie(&http.Cookie{Name: "sid", Value: tampered})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		is.Equal(rec.Body.String(), "1")
+	}
+	// Sealed values can't be moved to another cookie
+	sessions.Cookie.Name = "other"
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.AddCookie(&http.Cookie{Name: "other", Value: value})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	is.Equal(rec.Body.String(), "1")
+}
+
+func TestStatelessChunks(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	type Data struct {
+		Notes []string
+	}
+	sessions := sesh.New[Data]()
+	sessions.Now = futureDate
+	sessions.Store = nil
+	sessions.Stateless = true
+	sessions.Secrets = [][]byte{[]byte("secret")}
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		switch r.URL.Path {
+		case "/grow":
+			session.Notes = append(session.Notes, strings.Repeat("x", 4000))
+		case "/shrink":
+			session.Notes = session.Notes[:1]
+		case "/huge":
+			session.Notes = append(session.Notes, strings.Repeat("x", 40000))
+		}
+		w.Write([]byte(strconv.Itoa(len(session.Notes))))
+	}))
+	res := serve(jar, handler, httptest.NewRequest(http.MethodGet, "http://example.com/grow", nil))
+	is.Equal(len(res.Cookies()), 2)
+	is.Equal(res.Cookies()[0].Name, "sid")
+	is.Equal(res.Cookies()[1].Name, "sid.1")
+	res = serve(jar, handler, httptest.NewRequest(http.MethodGet, "http://example.com/grow", nil))
+	is.Equal(len(res.Cookies()), 3)
+	is.Equal(res.Cookies()[2].Name, "sid.2")
+	for _, cookie := range res.Cookies() {
+		is.True(len(cookie.String()) < 4096)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	for _, cookie := range jar.Cookies(req.URL) {
+		req.AddCookie(cookie)
+	}
+	handler.ServeHTTP(rec, req)
+	is.Equal(rec.Body.String(), "2")
+	// Leftover cookies are expired when the session shrinks
+	res = serve(jar, handler, httptest.NewRequest(http.MethodGet, "http://example.com/shrink", nil))
+	cookies := res.Cookies()
+	is.Equal(len(cookies), 3)
+	is.Equal(cookies[0].Name, "sid")
+	is.Equal(cookies[1].Name, "sid.1")
+	is.Equal(cookies[2].Name, "sid.2")
+	is.Equal(cookies[2].MaxAge, -1)
+	is.Equal(len(jar.Cookies(req.URL)), 2)
+	// Sessions that are too large result in an error
+	res = serve(jar, handler, httptest.NewRequest(http.MethodGet, "http://example.com/huge", nil))
+	is.Equal(res.StatusCode, http.StatusInternalServerError)
+}
+
+func TestStatelessDestroy(t *testing.T) {
+	is := is.New(t)
+	jar, err := cookiejar.New(nil)
+	is.NoErr(err)
+	sessions := statelessSessions()
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessions.Session(r)
+		session.Visits++
+		if r.URL.Path == "/logout" {
+			is.NoErr(sessions.Destroy(r))
+		}
+		w.Write([]byte(strconv.Itoa(session.Visits)))
+	}))
+	serve(jar, handler, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	serve(jar, handler, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	res := serve(jar, handler, httptest.NewRequest(http.MethodGet, "http://example.com/logout", nil))
+	is.Equal(res.Header.Get("Set-Cookie"), "sid=; Path=/; Max-Age=0; HttpOnly; SameSite=Lax")
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	for _, cookie := range jar.Cookies(req.URL) {
+		req.AddCookie(cookie)
+	}
+	handler.ServeHTTP(rec, req)
+	is.Equal(rec.Body.String(), "1")
+}
+
+func TestStatelessNoSecrets(t *testing.T) {
+	is := is.New(t)
+	sessions := statelessSessions()
+	sessions.Secrets = nil
+	handler := sessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	is.Equal(rec.Code, http.StatusInternalServerError)
+	is.Equal(rec.Body.String(), "sesh: stateless sessions require at least one secret\n")
+}
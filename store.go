@@ -2,6 +2,7 @@ package sesh
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
@@ -23,3 +24,47 @@ type Store interface {
 	// nil (not an error).
 	Delete(ctx context.Context, id string) (err error)
 }
+
+// Toucher is an optional interface that stores can implement to update the
+// expiry of a session without rewriting the session data. When the session
+// data hasn't changed, but the expiry has (e.g. with an idle timeout), the
+// manager will touch rather than upsert the session.
+type Toucher interface {
+	// Touch updates the expiry of the session id without changing its version.
+	// If the id does not exist then Touch should be a no-op and return nil (not
+	// an error).
+	Touch(ctx context.Context, id string, expiry time.Time) (err error)
+}
+
+// ErrConflict is returned by VersionedStore when the session was changed by
+// another request after it was loaded.
+var ErrConflict = errors.New("sesh: session was changed by another request")
+
+// VersionedStore is an optional interface that stores can implement to detect
+// concurrent changes to the same session. Every write to a session increments
+// its version, starting at 1.
+//
+// Stores that wrap another store implement VersionedStore and Lister by
+// forwarding to the store they wrap. When the wrapped store doesn't implement
+// the interface, they return errors.ErrUnsupported, and callers treat the store
+// as if it didn't implement the interface either.
+type VersionedStore interface {
+	// FindVersion is like Find, but also returns the version of the session. If
+	// the session id is not found or expired, the version will be 0.
+	FindVersion(ctx context.Context, id string) (data []byte, expiry time.Time, version int64, err error)
+
+	// UpsertIfVersion is like Upsert, but only writes the session if its version
+	// in the store still matches version. A version of 0 means that the session
+	// should not exist or be expired. If the versions don't match,
+	// UpsertIfVersion should return ErrConflict.
+	UpsertIfVersion(ctx context.Context, id string, data []byte, expiry time.Time, version int64) (err error)
+}
+
+// Lister is an optional interface that stores can implement to list their
+// sessions. It's used to copy sessions between stores.
+type Lister interface {
+	// List calls fn with the id of every session that hasn't expired. Sessions
+	// written while listing may or may not be listed. If fn returns an error,
+	// List stops and returns the error.
+	List(ctx context.Context, fn func(id string) error) (err error)
+}
@@ -0,0 +1,334 @@
+// Package storetest tests that a session store follows the sesh.Store
+// contract. Store implementations can run the suite from their own tests:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(t testing.TB) sesh.Store {
+//			return mystore.New()
+//		})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/sesh"
+	"golang.org/x/sync/errgroup"
+)
+
+// Run the store conformance tests. New is called to create an empty store for
+// each test. Optional interfaces like sesh.Toucher and sesh.VersionedStore are
+// tested when the store implements them, unless they return
+// errors.ErrUnsupported.
+func Run(t *testing.T, new func(t testing.TB) sesh.Store) {
+	t.Run("FindMissing", func(t *testing.T) { testFindMissing(t, new(t)) })
+	t.Run("UpsertFind", func(t *testing.T) { testUpsertFind(t, new(t)) })
+	t.Run("Overwrite", func(t *testing.T) { testOverwrite(t, new(t)) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, new(t)) })
+	t.Run("DeleteMissing", func(t *testing.T) { testDeleteMissing(t, new(t)) })
+	t.Run("Expired", func(t *testing.T) { testExpired(t, new(t)) })
+	t.Run("Isolated", func(t *testing.T) { testIsolated(t, new(t)) })
+	t.Run("BinaryData", func(t *testing.T) { testBinaryData(t, new(t)) })
+	t.Run("LargeData", func(t *testing.T) { testLargeData(t, new(t)) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, new(t)) })
+	t.Run("Canceled", func(t *testing.T) { testCanceled(t, new(t)) })
+	t.Run("Touch", func(t *testing.T) {
+		store, ok := new(t).(sesh.Toucher)
+		if !ok {
+			t.Skip("store doesn't implement sesh.Toucher")
+		}
+		testTouch(t, store.(sesh.Store), store)
+	})
+	t.Run("List", func(t *testing.T) {
+		store, ok := new(t).(sesh.Lister)
+		if !ok {
+			t.Skip("store doesn't implement sesh.Lister")
+		}
+		testList(t, store.(sesh.Store), store)
+	})
+	t.Run("Versioned", func(t *testing.T) {
+		store, ok := new(t).(sesh.VersionedStore)
+		if !ok {
+			t.Skip("store doesn't implement sesh.VersionedStore")
+		}
+		testVersioned(t, store.(sesh.Store), store)
+	})
+}
+
+func testFindMissing(t *testing.T, store sesh.Store) {
+	ctx := context.Background()
+	is := is.New(t)
+	data, expiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.True(expiry.IsZero())
+}
+
+func testUpsertFind(t *testing.T, store sesh.Store) {
+	ctx := context.Background()
+	is := is.New(t)
+	inputData := []byte("encoded_data")
+	inputExpiry := time.Now().Add(time.Minute)
+	err := store.Upsert(ctx, "session_token", inputData, inputExpiry)
+	is.NoErr(err)
+	actualData, actualExpiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(actualData), string(inputData))
+	is.Equal(actualExpiry.Unix(), inputExpiry.Unix())
+}
+
+func testOverwrite(t *testing.T, store sesh.Store) {
+	ctx := context.Background()
+	is := is.New(t)
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	newData := []byte("new_encoded_data")
+	newExpiry := time.Now().Add(time.Hour)
+	err = store.Upsert(ctx, "session_token", newData, newExpiry)
+	is.NoErr(err)
+	actualData, actualExpiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(actualData), string(newData))
+	is.Equal(actualExpiry.Unix(), newExpiry.Unix())
+}
+
+func testDelete(t *testing.T, store sesh.Store) {
+	ctx := context.Background()
+	is := is.New(t)
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	err = store.Delete(ctx, "session_token")
+	is.NoErr(err)
+	data, expiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.True(expiry.IsZero())
+}
+
+func testDeleteMissing(t *testing.T, store sesh.Store) {
+	ctx := context.Background()
+	is := is.New(t)
+	err := store.Delete(ctx, "session_token")
+	is.NoErr(err)
+	err = store.Delete(ctx, "session_token")
+	is.NoErr(err)
+}
+
+func testExpired(t *testing.T, store sesh.Store) {
+	ctx := context.Background()
+	is := is.New(t)
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(-time.Minute))
+	is.NoErr(err)
+	data, expiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.True(expiry.IsZero())
+	// Expired sessions can be replaced
+	inputExpiry := time.Now().Add(time.Minute)
+	err = store.Upsert(ctx, "session_token", []byte("new_encoded_data"), inputExpiry)
+	is.NoErr(err)
+	data, expiry, err = store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "new_encoded_data")
+	is.Equal(expiry.Unix(), inputExpiry.Unix())
+}
+
+func testIsolated(t *testing.T, store sesh.Store) {
+	ctx := context.Background()
+	is := is.New(t)
+	expiry := time.Now().Add(time.Minute)
+	is.NoErr(store.Upsert(ctx, "s1", []byte("1"), expiry))
+	is.NoErr(store.Upsert(ctx, "s2", []byte("2"), expiry))
+	is.NoErr(store.Delete(ctx, "s1"))
+	data, _, err := store.Find(ctx, "s1")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	data, _, err = store.Find(ctx, "s2")
+	is.NoErr(err)
+	is.Equal(string(data), "2")
+}
+
+func testBinaryData(t *testing.T, store sesh.Store) {
+	ctx := context.Background()
+	is := is.New(t)
+	inputData := make([]byte, 256)
+	for i := range inputData {
+		inputData[i] = byte(i)
+	}
+	err := store.Upsert(ctx, "session_token", inputData, time.Now().Add(time.Minute))
+	is.NoErr(err)
+	actualData, _, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.True(bytes.Equal(actualData, inputData))
+}
+
+func testLargeData(t *testing.T, store sesh.Store) {
+	ctx := context.Background()
+	is := is.New(t)
+	inputData := make([]byte, 1<<20)
+	_, err := rand.Read(inputData)
+	is.NoErr(err)
+	err = store.Upsert(ctx, "session_token", inputData, time.Now().Add(time.Minute))
+	is.NoErr(err)
+	actualData, _, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.True(bytes.Equal(actualData, inputData))
+}
+
+func testConcurrent(t *testing.T, store sesh.Store) {
+	ctx := context.Background()
+	is := is.New(t)
+	eg := errgroup.Group{}
+	for i := 0; i < 50; i++ {
+		eg.Go(func() error {
+			inputKey := "s" + strconv.Itoa(i)
+			inputExpiry := time.Now().Add(time.Minute)
+			for j := 0; j < 5; j++ {
+				inputData := []byte("d" + strconv.Itoa(i) + "." + strconv.Itoa(j))
+				if err := store.Upsert(ctx, inputKey, inputData, inputExpiry); err != nil {
+					return err
+				}
+				actualData, actualExpiry, err := store.Find(ctx, inputKey)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(actualData, inputData) {
+					return fmt.Errorf("expected %q, got %q", inputData, actualData)
+				}
+				if actualExpiry.Unix() != inputExpiry.Unix() {
+					return fmt.Errorf("expected %v, got %v", inputExpiry, actualExpiry)
+				}
+			}
+			return store.Delete(ctx, inputKey)
+		})
+	}
+	is.NoErr(eg.Wait())
+}
+
+func testCanceled(t *testing.T, store sesh.Store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	is := is.New(t)
+	_, _, err := store.Find(ctx, "session_token")
+	is.True(errors.Is(err, context.Canceled))
+	err = store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.True(errors.Is(err, context.Canceled))
+	err = store.Delete(ctx, "session_token")
+	is.True(errors.Is(err, context.Canceled))
+	// Nothing was written
+	data, _, err := store.Find(context.Background(), "session_token")
+	is.NoErr(err)
+	is.Equal(data, nil)
+}
+
+func testTouch(t *testing.T, store sesh.Store, toucher sesh.Toucher) {
+	ctx := context.Background()
+	is := is.New(t)
+	err := store.Upsert(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	is.NoErr(err)
+	newExpiry := time.Now().Add(time.Hour)
+	err = toucher.Touch(ctx, "session_token", newExpiry)
+	is.NoErr(err)
+	data, expiry, err := store.Find(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "encoded_data")
+	is.Equal(expiry.Unix(), newExpiry.Unix())
+	// Touching a missing session is a no-op
+	err = toucher.Touch(ctx, "missing", newExpiry)
+	is.NoErr(err)
+	data, expiry, err = store.Find(ctx, "missing")
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.True(expiry.IsZero())
+}
+
+func testVersioned(t *testing.T, store sesh.Store, versioned sesh.VersionedStore) {
+	ctx := context.Background()
+	is := is.New(t)
+	inputExpiry := time.Now().Add(time.Minute)
+	data, expiry, version, err := versioned.FindVersion(ctx, "session_token")
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("store wraps a store that doesn't implement sesh.VersionedStore")
+	}
+	is.NoErr(err)
+	is.Equal(data, nil)
+	is.True(expiry.IsZero())
+	is.Equal(version, int64(0))
+	// Insert a new session
+	err = versioned.UpsertIfVersion(ctx, "session_token", []byte("v1"), inputExpiry, 0)
+	is.NoErr(err)
+	data, expiry, version, err = versioned.FindVersion(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "v1")
+	is.Equal(expiry.Unix(), inputExpiry.Unix())
+	is.Equal(version, int64(1))
+	// The session already exists
+	err = versioned.UpsertIfVersion(ctx, "session_token", []byte("v1"), inputExpiry, 0)
+	is.True(errors.Is(err, sesh.ErrConflict))
+	// Update the session
+	err = versioned.UpsertIfVersion(ctx, "session_token", []byte("v2"), inputExpiry, 1)
+	is.NoErr(err)
+	// Stale version
+	err = versioned.UpsertIfVersion(ctx, "session_token", []byte("v3"), inputExpiry, 1)
+	is.True(errors.Is(err, sesh.ErrConflict))
+	// Plain upserts also increment the version
+	err = store.Upsert(ctx, "session_token", []byte("v3"), inputExpiry)
+	is.NoErr(err)
+	data, _, version, err = versioned.FindVersion(ctx, "session_token")
+	is.NoErr(err)
+	is.Equal(string(data), "v3")
+	is.Equal(version, int64(3))
+	// Removed sessions conflict with existing versions
+	err = store.Delete(ctx, "session_token")
+	is.NoErr(err)
+	err = versioned.UpsertIfVersion(ctx, "session_token", []byte("v4"), inputExpiry, 3)
+	is.True(errors.Is(err, sesh.ErrConflict))
+	// Expired sessions can be replaced
+	err = store.Upsert(ctx, "expired_token", []byte("old"), time.Now().Add(-time.Minute))
+	is.NoErr(err)
+	err = versioned.UpsertIfVersion(ctx, "expired_token", []byte("new"), inputExpiry, 0)
+	is.NoErr(err)
+	data, _, version, err = versioned.FindVersion(ctx, "expired_token")
+	is.NoErr(err)
+	is.Equal(string(data), "new")
+	is.Equal(version, int64(1))
+}
+
+func testList(t *testing.T, store sesh.Store, lister sesh.Lister) {
+	ctx := context.Background()
+	is := is.New(t)
+	for _, id := range []string{"s3", "s1", "s2"} {
+		err := store.Upsert(ctx, id, []byte("encoded_data"), time.Now().Add(time.Minute))
+		is.NoErr(err)
+	}
+	err := store.Upsert(ctx, "expired", []byte("encoded_data"), time.Now().Add(-time.Minute))
+	is.NoErr(err)
+	var ids []string
+	err = lister.List(ctx, func(id string) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("store wraps a store that doesn't implement sesh.Lister")
+	}
+	is.NoErr(err)
+	sort.Strings(ids)
+	is.Equal(ids, []string{"s1", "s2", "s3"})
+	// Errors stop listing
+	errStop := errors.New("stop")
+	calls := 0
+	err = lister.List(ctx, func(id string) error {
+		calls++
+		return errStop
+	})
+	is.True(errors.Is(err, errStop))
+	is.Equal(calls, 1)
+}